@@ -4,6 +4,7 @@ set -e
 
 OS="darwin linux windows"
 ARCH="amd64"
+VERSION=${VERSION:-$(git describe --tags --always 2>/dev/null || echo dev)}
 
 echo "Getting build dependencies"
 go get -t github.com/skytap/docker-machine-driver-skytap/docker/driver
@@ -13,6 +14,6 @@ for GOOS in $OS; do
         arch="$GOOS-$GOARCH"
         binary="bin/docker-machine-driver-skytap.$arch"
         echo "Building $binary"
-        GOOS=$GOOS GOARCH=$GOARCH go build -o $binary github.com/skytap/docker-machine-driver-skytap/docker/driver/cmd/
+        GOOS=$GOOS GOARCH=$GOARCH go build -ldflags "-X github.com/skytap/docker-machine-driver-skytap/docker/driver.Version=$VERSION" -o $binary github.com/skytap/docker-machine-driver-skytap/docker/driver/cmd/
     done
 done
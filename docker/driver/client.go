@@ -0,0 +1,141 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/skytap/skytap-sdk-go/api"
+)
+
+const defaultApiTimeout = 60 * time.Second
+
+// ClientFactory builds the Skytap API client used by every driver operation.
+// Replacing it on a Driver points the driver at a proxy, a regional or
+// on-premises endpoint, or a test double.
+type ClientFactory func(d *Driver) *api.SkytapClient
+
+// DefaultClientFactory creates a client from the driver's credentials that
+// sends its requests through the driver's HTTP client, so they are retried
+// and redirected as configured.
+func DefaultClientFactory(d *Driver) *api.SkytapClient {
+	client := api.NewSkytapClientFromCredentials(d.ClientCredentials)
+	client.HttpClient = d.httpClient()
+	return client
+}
+
+func (d *Driver) client() api.SkytapClient {
+	factory := d.ClientFactory
+	if factory == nil {
+		factory = DefaultClientFactory
+	}
+	return *factory(d)
+}
+
+// httpClient returns the HTTP client for Skytap API requests. It is based on
+// the driver's HTTPClient if one was supplied, otherwise on a client that
+// honors the usual proxy environment variables. Each attempt at a request
+// times out if Skytap does not respond in time. Failed requests are retried according to the
+// driver's retry policy and, when an API URL other than Skytap's is
+// configured, requests are redirected to it.
+func (d *Driver) httpClient() *http.Client {
+	httpClient := d.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				TLSHandshakeTimeout: 10 * time.Second,
+			},
+		}
+	}
+	transport := httpClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	if d.ApiUrl != "" && d.ApiUrl != skytapApiUrl {
+		if target, err := parseApiUrl(d.ApiUrl); err == nil {
+			transport = &endpointTransport{target, transport}
+		}
+	}
+
+	wrapped := *httpClient
+	// The timeout applies to each attempt rather than the whole client call,
+	// so that retries are not cut short.
+	wrapped.Transport = &retryTransport{d.retryPolicy(), defaultApiTimeout, transport}
+	return &wrapped
+}
+
+// withContext returns a copy of client whose requests are made with ctx, so
+// that SDK calls, which take no context of their own, give up once it is done.
+func withContext(ctx context.Context, client api.SkytapClient) api.SkytapClient {
+	httpClient := http.Client{}
+	if client.HttpClient != nil {
+		httpClient = *client.HttpClient
+	}
+	transport := httpClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	httpClient.Transport = &contextTransport{ctx, transport}
+	client.HttpClient = &httpClient
+	return client
+}
+
+// contextTransport sends requests with a fixed context.
+type contextTransport struct {
+	ctx  context.Context
+	next http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.next.RoundTrip(req.WithContext(t.ctx))
+}
+
+func parseApiUrl(apiUrl string) (*url.URL, error) {
+	target, err := url.Parse(apiUrl)
+	if err != nil {
+		return nil, err
+	}
+	if target.Scheme == "" || target.Host == "" {
+		return nil, fmt.Errorf("Invalid Skytap API URL '%s', must include scheme and host", apiUrl)
+	}
+	return target, nil
+}
+
+// endpointTransport sends requests addressed to the Skytap API to another
+// base URL, preserving the request path below the base URL's own path.
+type endpointTransport struct {
+	target *url.URL
+	next   http.RoundTripper
+}
+
+func (t *endpointTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u := *req.URL
+	u.Scheme = t.target.Scheme
+	u.Host = t.target.Host
+	u.Path = strings.TrimSuffix(t.target.Path, "/") + req.URL.Path
+	u.RawPath = ""
+
+	redirected := *req
+	redirected.URL = &u
+	redirected.Host = t.target.Host
+	return t.next.RoundTrip(&redirected)
+}
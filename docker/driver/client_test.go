@@ -0,0 +1,119 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skytap/skytap-sdk-go/api"
+)
+
+func TestApiUrlRedirectsAllRequests(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	env, vms := e.server.AddEnvironment("env", "vm")
+
+	// The custom endpoint serves the fake API below a path of its own.
+	var lock sync.Mutex
+	var paths []string
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		paths = append(paths, r.URL.Path)
+		lock.Unlock()
+		http.StripPrefix("/skytap", e.server.Config.Handler).ServeHTTP(w, r)
+	}))
+	defer endpoint.Close()
+
+	flags := e.templateFlags()
+	flags["skytap-api-url"] = endpoint.URL + "/skytap/"
+	d := e.driver(flags)
+	d.HTTPClient = nil
+	client := d.client()
+
+	if _, err := api.GetVirtualMachine(client, vms[0].Id); err != nil {
+		t.Fatalf("SDK request: %s", err)
+	}
+	if err := skytapRequest(client, "GET", vmPath(env.Id, vms[0].Id), nil, nil); err != nil {
+		t.Fatalf("driver request: %s", err)
+	}
+
+	want := []string{"/skytap/vms/" + vms[0].Id, "/skytap" + vmPath(env.Id, vms[0].Id)}
+	if strings.Join(paths, " ") != strings.Join(want, " ") {
+		t.Errorf("endpoint received %v, want %v", paths, want)
+	}
+	if requests := e.server.Requests(); len(requests) != 2 {
+		t.Errorf("fake API received %v, want both requests", requests)
+	}
+}
+
+func TestSetConfigFromFlagsValidatesApiUrl(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr string
+	}{
+		{"https://skytap.example.com/api", ""},
+		{"not-a-url", "Invalid Skytap API URL 'not-a-url'"},
+		{"skytap.example.com/api", "must include scheme and host"},
+		{"https://", "must include scheme and host"},
+	}
+
+	e := newTestEnv(t)
+	defer e.close()
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			flags := e.templateFlags()
+			flags["skytap-api-url"] = test.url
+			_, err := e.configure(flags)
+			checkError(t, err, test.wantErr)
+		})
+	}
+}
+
+func TestWithContextBoundsSdkCalls(t *testing.T) {
+	hung := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-hung:
+		}
+	}))
+	defer server.Close()
+	defer close(hung)
+
+	d := NewDriver(testMachineName, "").(*Driver)
+	d.ApiUrl = server.URL
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := api.GetVirtualMachine(withContext(ctx, d.client()), "1")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("request succeeded after its context expired")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request ignored its context")
+	}
+}
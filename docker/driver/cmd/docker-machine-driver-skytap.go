@@ -15,10 +15,24 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
+
 	"github.com/docker/machine/libmachine/drivers/plugin"
 	"github.com/skytap/docker-machine-driver-skytap/docker/driver"
 )
 
 func main() {
+	// Started as "docker-machine-driver-skytap skytap <command>", the binary
+	// manages existing machines instead of serving docker-machine.
+	if len(os.Args) > 1 && os.Args[1] == "skytap" {
+		// Help is not an error; the usage has already been printed.
+		if err := skytap(os.Args[2:]); err != nil && err != flag.ErrHelp {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	plugin.RegisterDriver(driver.NewDriver("", ""))
 }
@@ -0,0 +1,58 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/skytap/skytap-sdk-go/api"
+)
+
+// resize changes the CPUs and RAM of a machine and records the new hardware
+// in its config.
+func resize(args []string) error {
+	flags := newFlagSet("resize", "[options] <machine>")
+	storePath := flags.String("storage-path", defaultStorePath(), "docker-machine store")
+	cpus := flags.Int("cpus", 0, "number of CPUs")
+	cpusPerSocket := flags.Int("cpus-per-socket", 0, "number of CPUs per virtual socket")
+	ram := flags.Int("ram", 0, "RAM in megabytes")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := requireMachine(flags); err != nil {
+		return err
+	}
+
+	hc := api.Hardware{}
+	if *cpus != 0 {
+		hc.Cpus = cpus
+	}
+	if *cpusPerSocket != 0 {
+		hc.CpusPerSocket = cpusPerSocket
+	}
+	if *ram != 0 {
+		hc.Ram = ram
+	}
+
+	machine, err := loadMachine(*storePath, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	resizeErr := machine.driver.Resize(hc)
+	// Save even if resizing failed part way, since the VM may have been
+	// stopped or changed.
+	if err = machine.save(); err != nil {
+		return err
+	}
+	return resizeErr
+}
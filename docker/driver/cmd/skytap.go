@@ -0,0 +1,163 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+const usagePrefix = "Usage: docker-machine-driver-skytap skytap"
+
+// stdout and stderr receive the commands' output and usage messages.
+var (
+	stdout io.Writer = os.Stdout
+	stderr io.Writer = os.Stderr
+)
+
+// commands are the Skytap operations on existing machines that docker-machine
+// has no command for.
+var commands = map[string]func(args []string) error{
+	"info":     info,
+	"gc":       gc,
+	"resize":   resize,
+	"snapshot": snapshot,
+}
+
+// skytap runs the command named by the first argument. Asked for help, it
+// prints the usage and returns flag.ErrHelp, as the commands do.
+func skytap(args []string) error {
+	if len(args) > 0 {
+		if command, ok := commands[args[0]]; ok {
+			return command(args[1:])
+		}
+	}
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	usage := fmt.Sprintf("%s %s <machine>", usagePrefix, strings.Join(names, "|"))
+	if len(args) > 0 && (args[0] == "-h" || args[0] == "-help" || args[0] == "--help" || args[0] == "help") {
+		fmt.Fprintln(stderr, usage)
+		return flag.ErrHelp
+	}
+	return errors.New(usage)
+}
+
+func newFlagSet(command, arguments string) *flag.FlagSet {
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "%s %s %s\n", usagePrefix, command, arguments)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+func requireMachine(flags *flag.FlagSet) error {
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("Expected exactly one machine name")
+	}
+	return nil
+}
+
+// info prints the Skytap resources behind a machine.
+func info(args []string) error {
+	flags := newFlagSet("info", "[options] <machine>")
+	storePath := flags.String("storage-path", defaultStorePath(), "docker-machine store")
+	asJSON := flags.Bool("json", false, "print the information as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := requireMachine(flags); err != nil {
+		return err
+	}
+
+	machine, err := loadMachine(*storePath, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	details, err := machine.driver.Info()
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(details)
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Machine:\t%s\n", details.MachineName)
+	fmt.Fprintf(w, "VM:\t%s (%s)\n", details.VmName, details.VmId)
+	fmt.Fprintf(w, "Runstate:\t%s\n", details.Runstate)
+	fmt.Fprintf(w, "Environment:\t%s (%s)\n", details.EnvironmentName, details.EnvironmentId)
+	fmt.Fprintf(w, "Created for machine:\t%t\n", details.OwnsEnvironment)
+	fmt.Fprintf(w, "IP address:\t%s\n", details.IPAddress)
+	if details.PublicIp != "" {
+		fmt.Fprintf(w, "Public IP:\t%s\n", details.PublicIp)
+	}
+	if details.ICNRTunnelId != "" {
+		fmt.Fprintf(w, "ICNR tunnel:\t%s\n", details.ICNRTunnelId)
+	}
+	fmt.Fprintf(w, "CPUs:\t%d (%d per socket)\n", details.Cpus, details.CpusPerSocket)
+	fmt.Fprintf(w, "RAM:\t%d MB\n", details.Ram)
+	fmt.Fprintf(w, "Disks:\t%v MB\n", details.DiskSizes)
+	return w.Flush()
+}
+
+// gc deletes the environment and ICNR tunnel created for a machine whose VM
+// no longer exists in Skytap.
+func gc(args []string) error {
+	flags := newFlagSet("gc", "[options] <machine>")
+	storePath := flags.String("storage-path", defaultStorePath(), "docker-machine store")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := requireMachine(flags); err != nil {
+		return err
+	}
+
+	machine, err := loadMachine(*storePath, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	removed, gcErr := machine.driver.CollectGarbage()
+	for _, resource := range removed {
+		fmt.Fprintf(stdout, "Deleted %s\n", resource)
+	}
+	if len(removed) > 0 {
+		if err = machine.save(); err != nil {
+			return err
+		}
+	}
+	if gcErr != nil {
+		return gcErr
+	}
+	if len(removed) == 0 {
+		fmt.Fprintln(stdout, "Nothing to delete")
+	}
+	fmt.Fprintf(stdout, "Remove the machine from docker-machine with: docker-machine rm -f %s\n", flags.Arg(0))
+	return nil
+}
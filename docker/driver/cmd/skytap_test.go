@@ -0,0 +1,331 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/skytap/docker-machine-driver-skytap/docker/driver"
+	"github.com/skytap/docker-machine-driver-skytap/docker/driver/skytaptest"
+)
+
+const testMachineName = "machine"
+
+// testStore is a docker-machine store holding a Skytap machine whose VM and
+// environment live in a fake Skytap, and a machine of another driver.
+type testStore struct {
+	path   string
+	server *skytaptest.Server
+	env    *skytaptest.Environment
+	vm     *skytaptest.VM
+}
+
+func newTestStore(t *testing.T) *testStore {
+	path, err := ioutil.TempDir("", "skytap-cmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testStore{path: path, server: skytaptest.NewServer()}
+	var vms []*skytaptest.VM
+	s.env, vms = s.server.AddEnvironment("docker-machine-machine", "docker")
+	s.vm = vms[0]
+
+	d := driver.NewDriver(testMachineName, path).(*driver.Driver)
+	d.ApiUrl = s.server.URL
+	d.DeviceConfig.EnvironmentId = s.env.Id
+	d.Vm.Id = s.vm.Id
+	d.OwnsEnvironment = true
+	s.writeConfig(t, testMachineName, "skytap", d)
+	s.writeConfig(t, "other", "virtualbox", map[string]string{})
+	return s
+}
+
+func (s *testStore) close() {
+	s.server.Close()
+	os.RemoveAll(s.path)
+}
+
+func (s *testStore) writeConfig(t *testing.T, name, driverName string, d interface{}) {
+	data, err := json.Marshal(map[string]interface{}{
+		"ConfigVersion": 3,
+		"Driver":        d,
+		"DriverName":    driverName,
+		"Name":          name,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(s.path, "machines", name)
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "config.json"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// saved returns the machine's config.json as the next command would read it.
+func (s *testStore) saved(t *testing.T) (map[string]json.RawMessage, *driver.Driver) {
+	machine, err := loadMachine(s.path, testMachineName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return machine.fields, machine.driver
+}
+
+// deleteVM deletes the machine's VM behind docker-machine's back.
+func (s *testStore) deleteVM(t *testing.T) {
+	req, err := http.NewRequest("DELETE", s.server.URL+"/vms/"+s.vm.Id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+type commandTest struct {
+	name string
+	args []string
+	// useEnv passes the store in MACHINE_STORAGE_PATH rather than with
+	// --storage-path.
+	useEnv  bool
+	setup   func(t *testing.T, s *testStore)
+	wantErr string
+	want    []string
+	check   func(t *testing.T, s *testStore)
+}
+
+// argumentTests are the argument and config errors every command reports
+// before it asks Skytap anything. options are the command's required flags.
+func argumentTests(options ...string) []commandTest {
+	with := func(args ...string) []string {
+		return append(append([]string(nil), options...), args...)
+	}
+	return []commandTest{
+		{name: "help", args: []string{"-h"}, wantErr: flag.ErrHelp.Error()},
+		{name: "unknown flag", args: with("--bogus", testMachineName), wantErr: "flag provided but not defined: -bogus"},
+		{name: "no machine", args: with(), wantErr: "Expected exactly one machine name"},
+		{name: "two machines", args: with(testMachineName, "other"), wantErr: "Expected exactly one machine name"},
+		{name: "unknown machine", args: with("missing"), wantErr: "Unable to read the config of machine 'missing'"},
+		{name: "other driver", args: with("other"), wantErr: "Machine 'other' uses the 'virtualbox' driver, not 'skytap'"},
+	}
+}
+
+func runCommandTests(t *testing.T, command func(args []string) error, tests []commandTest) {
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestStore(t)
+			defer s.close()
+			if test.setup != nil {
+				test.setup(t, s)
+			}
+			args := append([]string{"--storage-path", s.path}, test.args...)
+			if test.useEnv {
+				defer os.Setenv("MACHINE_STORAGE_PATH", os.Getenv("MACHINE_STORAGE_PATH"))
+				os.Setenv("MACHINE_STORAGE_PATH", s.path)
+				args = test.args
+			}
+			var out, errOut bytes.Buffer
+			stdout, stderr = &out, &errOut
+			defer func() { stdout, stderr = os.Stdout, os.Stderr }()
+
+			err := command(args)
+
+			checkError(t, err, test.wantErr)
+			for _, want := range test.want {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("output does not contain %q:\n%s", want, out.String())
+				}
+			}
+			if test.wantErr != "" && out.Len() > 0 {
+				t.Errorf("unexpected output:\n%s", out.String())
+			}
+			if test.check != nil {
+				test.check(t, s)
+			}
+		})
+	}
+}
+
+// checkError fails the test unless err contains want, or err is nil when
+// want is empty. Help must be reported as flag.ErrHelp itself, which the
+// binary does not treat as a failure.
+func checkError(t *testing.T, err error, want string) {
+	switch {
+	case want == "":
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	case want == flag.ErrHelp.Error():
+		if err != flag.ErrHelp {
+			t.Fatalf("error %v, want flag.ErrHelp", err)
+		}
+	case err == nil:
+		t.Fatalf("no error, want %q", want)
+	case !strings.Contains(err.Error(), want):
+		t.Fatalf("error %q, want %q", err, want)
+	}
+}
+
+func TestSkytap(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{"no command", nil, "Usage: docker-machine-driver-skytap skytap gc|info|resize|snapshot <machine>"},
+		{"unknown command", []string{"bogus"}, "Usage: docker-machine-driver-skytap skytap gc|info|resize|snapshot <machine>"},
+		{"help", []string{"-h"}, flag.ErrHelp.Error()},
+		{"help command", []string{"help"}, flag.ErrHelp.Error()},
+		{"command help", []string{"info", "--help"}, flag.ErrHelp.Error()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var errOut bytes.Buffer
+			stderr = &errOut
+			defer func() { stderr = os.Stderr }()
+
+			err := skytap(test.args)
+
+			checkError(t, err, test.wantErr)
+			if err == flag.ErrHelp && !strings.Contains(errOut.String(), usagePrefix) {
+				t.Errorf("usage not printed: %q", errOut.String())
+			}
+		})
+	}
+}
+
+func TestInfo(t *testing.T) {
+	runCommandTests(t, info, append(argumentTests(),
+		commandTest{
+			name: "table",
+			args: []string{testMachineName},
+			want: []string{"Machine:", "docker", "Environment:", "docker-machine-machine", "stopped", "1 (1 per socket)", "1024 MB"},
+		},
+		commandTest{
+			name:   "store from environment",
+			args:   []string{testMachineName},
+			useEnv: true,
+			want:   []string{"Machine:"},
+		},
+		commandTest{
+			name: "JSON",
+			args: []string{"--json", testMachineName},
+			want: []string{`"MachineName": "machine"`, `"OwnsEnvironment": true`, `"Ram": 1024`},
+		},
+		commandTest{
+			name:    "VM deleted",
+			args:    []string{testMachineName},
+			setup:   func(t *testing.T, s *testStore) { s.deleteVM(t) },
+			wantErr: "404",
+		},
+	))
+}
+
+func TestGc(t *testing.T) {
+	runCommandTests(t, gc, append(argumentTests(),
+		commandTest{
+			name:    "VM exists",
+			args:    []string{testMachineName},
+			wantErr: "still exists",
+		},
+		commandTest{
+			name:  "VM deleted",
+			args:  []string{testMachineName},
+			setup: func(t *testing.T, s *testStore) { s.deleteVM(t) },
+			want:  []string{"Deleted environment", "docker-machine rm -f machine"},
+			check: func(t *testing.T, s *testStore) {
+				if _, ok := s.server.Environments[s.env.Id]; ok {
+					t.Error("environment not deleted")
+				}
+				if _, d := s.saved(t); d.OwnsEnvironment {
+					t.Error("deleted environment still recorded in the config")
+				}
+			},
+		},
+	))
+}
+
+func TestResize(t *testing.T) {
+	runCommandTests(t, resize, append(argumentTests(),
+		commandTest{
+			name: "CPUs and RAM",
+			args: []string{"--cpus", "2", "--ram", "2048", testMachineName},
+			check: func(t *testing.T, s *testStore) {
+				s.server.Lock()
+				cpus, ram := fmt.Sprint(s.vm.Hardware["cpus"]), fmt.Sprint(s.vm.Hardware["ram"])
+				s.server.Unlock()
+				if cpus != "2" || ram != "2048" {
+					t.Errorf("VM has %s CPUs and %s MB of RAM", cpus, ram)
+				}
+				fields, d := s.saved(t)
+				if hc := d.HardwareConfig; hc == nil || hc.Cpus == nil || *hc.Cpus != 2 || hc.Ram == nil || *hc.Ram != 2048 {
+					t.Errorf("config records hardware %+v", hc)
+				}
+				if string(fields["ConfigVersion"]) != "3" {
+					t.Errorf("config version %s not kept", fields["ConfigVersion"])
+				}
+			},
+		},
+		commandTest{
+			name:    "no change",
+			args:    []string{testMachineName},
+			wantErr: "No CPU or RAM change requested",
+		},
+		commandTest{
+			name:    "invalid CPUs",
+			args:    []string{"--cpus", "two", testMachineName},
+			wantErr: `invalid value "two" for flag -cpus`,
+		},
+	))
+}
+
+func TestSnapshot(t *testing.T) {
+	runCommandTests(t, snapshot, append(argumentTests("--name", "golden"),
+		commandTest{
+			name: "environment",
+			args: []string{"--name", "golden", testMachineName},
+			want: []string{"Created template", "'golden'", "--skytap-template-id"},
+			check: func(t *testing.T, s *testStore) {
+				s.server.Lock()
+				defer s.server.Unlock()
+				for _, template := range s.server.Templates {
+					if template.Name == "golden" {
+						return
+					}
+				}
+				t.Error("template not created")
+			},
+		},
+		commandTest{
+			name:    "no name",
+			args:    []string{testMachineName},
+			wantErr: "A template name is required",
+		},
+	))
+}
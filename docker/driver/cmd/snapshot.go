@@ -0,0 +1,54 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// snapshot saves a machine's environment, or only its VM, as a template that
+// new machines can be created from.
+func snapshot(args []string) error {
+	flags := newFlagSet("snapshot", "--name <template> [options] <machine>")
+	storePath := flags.String("storage-path", defaultStorePath(), "docker-machine store")
+	name := flags.String("name", "", "name of the template to create")
+	vmOnly := flags.Bool("vm-only", false, "save only the machine's VM, not its whole environment; always the case in an environment not created for the machine")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := requireMachine(flags); err != nil {
+		return err
+	}
+	if *name == "" {
+		flags.Usage()
+		return errors.New("A template name is required")
+	}
+
+	machine, err := loadMachine(*storePath, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	templateId, err := machine.driver.Snapshot(*name, *vmOnly)
+	if err != nil {
+		if templateId != "" {
+			return fmt.Errorf("Template %s was created but is not ready: %s", templateId, err)
+		}
+		return err
+	}
+	fmt.Fprintf(stdout, "Created template %s '%s'\n", templateId, *name)
+	fmt.Fprintf(stdout, "Create machines from it with: docker-machine create -d skytap --skytap-template-id %s ...\n", templateId)
+	return nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/machine/libmachine/mcnutils"
+	"github.com/skytap/docker-machine-driver-skytap/docker/driver"
+)
+
+// machineConfig is a machine's config.json in the docker-machine store. Only
+// the driver section is decoded; the rest is written back as it was read.
+type machineConfig struct {
+	path   string
+	fields map[string]json.RawMessage
+	driver *driver.Driver
+}
+
+// defaultStorePath returns the docker-machine store, as docker-machine itself
+// finds it.
+func defaultStorePath() string {
+	if path := os.Getenv("MACHINE_STORAGE_PATH"); path != "" {
+		return path
+	}
+	return filepath.Join(mcnutils.GetHomeDir(), ".docker", "machine")
+}
+
+// loadMachine reads the config of the named machine, which must have been
+// created with the Skytap driver.
+func loadMachine(storePath, name string) (*machineConfig, error) {
+	path := filepath.Join(storePath, "machines", name, "config.json")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the config of machine '%s': %s", name, err)
+	}
+
+	config := &machineConfig{path: path}
+	if err = json.Unmarshal(data, &config.fields); err != nil {
+		return nil, fmt.Errorf("Unable to parse %s: %s", path, err)
+	}
+	var driverName string
+	json.Unmarshal(config.fields["DriverName"], &driverName)
+	if driverName != "skytap" {
+		return nil, fmt.Errorf("Machine '%s' uses the '%s' driver, not 'skytap'", name, driverName)
+	}
+
+	config.driver = driver.NewDriver(name, storePath).(*driver.Driver)
+	if err = json.Unmarshal(config.fields["Driver"], config.driver); err != nil {
+		return nil, fmt.Errorf("Unable to parse the driver config in %s: %s", path, err)
+	}
+	return config, nil
+}
+
+// save writes the driver's state back to the machine's config.json.
+func (c *machineConfig) save() error {
+	data, err := json.Marshal(c.driver)
+	if err != nil {
+		return err
+	}
+	c.fields["Driver"] = data
+	if data, err = json.MarshalIndent(c.fields, "", "    "); err != nil {
+		return err
+	}
+
+	// Write a new file and rename it over the old one, so that the config is
+	// never left half written.
+	tmp := c.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
@@ -0,0 +1,170 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/skytap/skytap-sdk-go/api"
+)
+
+// Disk sizes Skytap accepts, in megabytes.
+const (
+	minDiskSize = 2048
+	maxDiskSize = 2096128
+	// maxDisks is the number of disks a Skytap VM can have.
+	maxDisks = 60
+)
+
+type disk struct {
+	Id   string `json:"id"`
+	Size int    `json:"size"`
+	Type string `json:"type"`
+}
+
+type vmDisks struct {
+	Hardware struct {
+		Disks []disk `json:"disks"`
+	} `json:"hardware"`
+}
+
+// parseDiskSizes parses --skytap-vm-disk-size values, in megabytes.
+func parseDiskSizes(values []string) ([]int, error) {
+	var sizes []int
+	for _, value := range values {
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid disk size '%s', must be a number of megabytes", value)
+		}
+		if err = checkDiskSize(size); err != nil {
+			return nil, err
+		}
+		sizes = append(sizes, size)
+	}
+	if len(sizes) >= maxDisks {
+		return nil, fmt.Errorf("A Skytap VM can have at most %d disks", maxDisks)
+	}
+	return sizes, nil
+}
+
+func checkDiskSize(size int) error {
+	if size < minDiskSize || size > maxDiskSize {
+		return fmt.Errorf("Disk size %d MB is outside the %d to %d MB Skytap allows", size, minDiskSize, maxDiskSize)
+	}
+	return nil
+}
+
+func vmPath(envId, vmId string) string {
+	return fmt.Sprintf("/configurations/%s/vms/%s", envId, vmId)
+}
+
+func getDisks(client api.SkytapClient, envId, vmId string) ([]disk, error) {
+	var vm vmDisks
+	if err := skytapRequest(client, "GET", vmPath(envId, vmId), nil, &vm); err != nil {
+		return nil, err
+	}
+	return vm.Hardware.Disks, nil
+}
+
+// provisionDisks grows the primary disk and adds new disks to a stopped VM
+// as requested with --skytap-vm-primary-disk-size and --skytap-vm-disk-size.
+// Only the disks themselves change; the primary disk's partitions and file
+// systems are left for the guest OS to grow.
+func (d *Driver) provisionDisks(client api.SkytapClient, envId, vmId string) error {
+	if d.PrimaryDiskSize == 0 && len(d.DiskSizes) == 0 {
+		return nil
+	}
+	disks, err := getDisks(client, envId, vmId)
+	if err != nil {
+		return err
+	}
+	if len(disks)+len(d.DiskSizes) > maxDisks {
+		return fmt.Errorf("VM %s has %d disks, adding %d would exceed the %d Skytap allows", vmId, len(disks), len(d.DiskSizes), maxDisks)
+	}
+
+	changes := map[string]interface{}{}
+	if d.PrimaryDiskSize != 0 {
+		if len(disks) == 0 {
+			return fmt.Errorf("VM %s has no disk to grow", vmId)
+		}
+		primary := disks[0]
+		if d.PrimaryDiskSize < primary.Size {
+			return fmt.Errorf("Primary disk of VM %s is %d MB, it cannot shrink to %d MB", vmId, primary.Size, d.PrimaryDiskSize)
+		}
+		if d.PrimaryDiskSize > primary.Size {
+			log.Infof("Growing primary disk from %d MB to %d MB", primary.Size, d.PrimaryDiskSize)
+			changes["existing"] = map[string]interface{}{
+				primary.Id: map[string]interface{}{"id": primary.Id, "size": d.PrimaryDiskSize},
+			}
+		}
+	}
+	if len(d.DiskSizes) > 0 {
+		log.Infof("Adding disks of %v MB", d.DiskSizes)
+		changes["new"] = d.DiskSizes
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	params := map[string]interface{}{"hardware": map[string]interface{}{"disks": changes}}
+	return skytapRequest(client, "PUT", vmPath(envId, vmId), params, nil)
+}
+
+// mountDockerDiskScript partitions a disk of the given size in bytes that has
+// no partitions and is not mounted, formats it and mounts it at
+// /var/lib/docker, including after reboots. Going by size rather than taking
+// the first unused disk keeps disks the source VM already had but left
+// unpartitioned, which the guest may list first, out of it. A VM created from
+// a snapshot of a machine already has its Docker disk mounted, and keeps it
+// rather than hiding it under an empty one.
+const mountDockerDiskScript = `set -e
+size=%d
+if mountpoint -q /var/lib/docker; then
+  echo "/var/lib/docker is already mounted, keeping it" >&2
+  exit 0
+fi
+dev=""
+for d in $(lsblk -dbnpo NAME,TYPE,SIZE | awk -v size="$size" '$2 == "disk" && $3 == size { print $1 }'); do
+  if [ "$(lsblk -nlo NAME "$d" | wc -l)" -eq 1 ] && ! grep -q "^$d " /proc/mounts; then
+    dev="$d"
+    break
+  fi
+done
+if [ -z "$dev" ]; then
+  echo "No unused disk of $size bytes found" >&2
+  exit 1
+fi
+echo ',,L' | sudo sfdisk -q "$dev"
+sudo udevadm settle
+part=$(lsblk -nlpo NAME "$dev" | sed -n 2p)
+sudo mkfs.ext4 -q "$part"
+sudo mkdir -p /var/lib/docker
+echo "UUID=$(sudo blkid -s UUID -o value "$part") /var/lib/docker ext4 defaults 0 2" | sudo tee -a /etc/fstab >/dev/null
+sudo mount /var/lib/docker
+`
+
+// mountDockerDisk mounts the first added disk at /var/lib/docker over SSH, so
+// that Docker's images and containers are stored on it. The script is not
+// safe to run twice, so it is not retried.
+func (d *Driver) mountDockerDisk() error {
+	log.Infof("Mounting the added disk at /var/lib/docker")
+	output, err := runSSHCommand(d, fmt.Sprintf(mountDockerDiskScript, d.DiskSizes[0]*1024*1024))
+	if err != nil {
+		return fmt.Errorf("Unable to mount the added disk at /var/lib/docker: %s: %s", err, output)
+	}
+	return nil
+}
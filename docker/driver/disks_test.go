@@ -0,0 +1,128 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/skytap/docker-machine-driver-skytap/docker/driver/skytaptest"
+)
+
+func TestParseDiskSizes(t *testing.T) {
+	tests := []struct {
+		values  []string
+		want    []int
+		wantErr string
+	}{
+		{nil, nil, ""},
+		{[]string{"2048", "10240"}, []int{2048, 10240}, ""},
+		{[]string{"10G"}, nil, "Invalid disk size '10G'"},
+		{[]string{"1024"}, nil, "outside the 2048 to 2096128 MB"},
+		{[]string{"4194304"}, nil, "outside the 2048 to 2096128 MB"},
+	}
+	for _, test := range tests {
+		got, err := parseDiskSizes(test.values)
+		checkError(t, err, test.wantErr)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parsed %v as %v, want %v", test.values, got, test.want)
+		}
+	}
+}
+
+func diskSizes(vm *skytaptest.VM) []int {
+	var sizes []int
+	for _, disk := range vm.Disks() {
+		sizes = append(sizes, int(disk["size"].(float64)))
+	}
+	return sizes
+}
+
+func TestCreateProvisionsDisks(t *testing.T) {
+	tests := []struct {
+		name        string
+		flags       map[string]interface{}
+		want        []int
+		wantCommand string
+	}{
+		{
+			name: "unchanged",
+			want: []int{skytaptest.PrimaryDiskSize},
+		},
+		{
+			name:  "primary disk grown",
+			flags: map[string]interface{}{"skytap-vm-primary-disk-size": 40960},
+			want:  []int{40960},
+		},
+		{
+			name:  "disks added",
+			flags: map[string]interface{}{"skytap-vm-disk-size": []string{"10240", "20480"}},
+			want:  []int{skytaptest.PrimaryDiskSize, 10240, 20480},
+		},
+		{
+			name: "Docker disk mounted",
+			flags: map[string]interface{}{
+				"skytap-vm-disk-size":      []string{"10240", "20480"},
+				"skytap-mount-docker-disk": true,
+			},
+			want:        []int{skytaptest.PrimaryDiskSize, 10240, 20480},
+			wantCommand: "size=10737418240\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer func(run func(drivers.Driver, string) (string, error)) { runSSHCommand = run }(runSSHCommand)
+			var commands []string
+			runSSHCommand = func(d drivers.Driver, command string) (string, error) {
+				commands = append(commands, command)
+				return "", nil
+			}
+			e := newTestEnv(t)
+			defer e.close()
+			flags := e.templateFlags()
+			for name, value := range test.flags {
+				flags[name] = value
+			}
+			d := e.create(flags)
+
+			e.server.Lock()
+			sizes := diskSizes(e.server.VMs[d.Vm.Id])
+			e.server.Unlock()
+			if !reflect.DeepEqual(sizes, test.want) {
+				t.Errorf("disks of %v MB, want %v MB", sizes, test.want)
+			}
+			switch {
+			case test.wantCommand == "" && len(commands) > 0:
+				t.Errorf("unexpected SSH commands %q", commands)
+			case test.wantCommand != "" && (len(commands) != 1 || !strings.Contains(commands[0], test.wantCommand)):
+				t.Errorf("SSH commands %q, want one selecting the disk with %q", commands, test.wantCommand)
+			}
+		})
+	}
+}
+
+func TestProvisionDisksRefusesToShrink(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	env, vms := e.server.AddEnvironment("env", "docker")
+	d := e.driver(map[string]interface{}{"skytap-vm-id": vms[0].Id})
+	d.PrimaryDiskSize = skytaptest.PrimaryDiskSize / 2
+
+	err := d.provisionDisks(d.client(), env.Id, vms[0].Id)
+	checkError(t, err, "cannot shrink")
+}
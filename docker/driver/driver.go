@@ -15,6 +15,7 @@
 package driver
 
 import (
+	"context"
 	"fmt"
 
 	"errors"
@@ -22,11 +23,17 @@ import (
 	"github.com/docker/machine/libmachine/drivers"
 	"github.com/docker/machine/libmachine/log"
 	"github.com/docker/machine/libmachine/mcnflag"
+	"github.com/docker/machine/libmachine/mcnutils"
 	dockerSsh "github.com/docker/machine/libmachine/ssh"
 	"github.com/docker/machine/libmachine/state"
 	"github.com/skytap/skytap-sdk-go/api"
 	"github.com/tmc/scp"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
 	"regexp"
 	"time"
 )
@@ -38,6 +45,7 @@ const (
 	defaultCPUs          = 0
 	defaultCPUsPerSocket = 0
 	defaultRAM           = 0
+	defaultStateCacheTTL = 60
 	driverName           = "skytap"
 )
 
@@ -53,12 +61,72 @@ type Driver struct {
 	LastState         state.State
 	HardwareConfig    *api.Hardware
 	ContainerHost			bool
+	SSHKey            string
+	KeepOnFailure     bool
+	ApiUrl            string
+	CreateTimeout     int
+	SSHTimeout        int
+	PhaseTimeout      int
+	ApiMaxRetries     int
+	ApiBackoff        int
+	// ClientFactory, HTTPClient and RetryPolicy may be set by code embedding
+	// the driver to control how it reaches the Skytap API; they are not persisted.
+	ClientFactory     ClientFactory `json:"-"`
+	HTTPClient        *http.Client  `json:"-"`
+	RetryPolicy       RetryPolicy   `json:"-"`
+	// OwnsEnvironment is set when Create built a new environment for this
+	// machine, so Remove knows it may delete the environment as well.
+	OwnsEnvironment   bool
+	// ICNRTunnelId is the inter-configuration network route Create made to
+	// reach the machine in an environment it owns, if it did not reuse an
+	// existing one.
+	ICNRTunnelId      string
+	PublicIpMode      string
+	// PublicIp and PublishedServices record what Create attached to make
+	// the machine reachable from the internet, so Remove can release it.
+	PublicIp          string
+	PublishedServices []publishedService
+	StopMode          string
+	StopTimeout       int
+	BusyWait          int
+	// LastAction is the last runstate transition the driver requested, used
+	// to tell whether a busy VM is starting or stopping.
+	LastAction        string
+	StateCacheTTL     int
+	// ResolvedAt is when Vm and IPAddress were last read from Skytap.
+	ResolvedAt        time.Time
+	Tags              []string
+	Labels            []string
+	// DiskSizes are the sizes in megabytes of the disks to add to the VM.
+	DiskSizes         []int
+	PrimaryDiskSize   int
+	MountDockerDisk   bool
 }
 
 type deviceConfig struct {
-	SourceVMId    string
-	EnvironmentId string
-	VPNId         string
+	SourceVMId     string
+	EnvironmentId  string
+	VPNId          string
+	NetworkId      string
+	NetworkName    string
+	InterfaceIndex int
+	// ICNRTargetNetworkId is the network outside the environment that the
+	// machine is reached from over an inter-configuration network route.
+	ICNRTargetNetworkId string
+	// TemplateId and TemplateVMName select the source VM from a template
+	// instead of by ID.
+	TemplateId     string
+	TemplateVMName string
+	// TemplateName, EnvironmentName and VPNName select resources by name;
+	// they are resolved to the corresponding IDs before the machine is created.
+	TemplateName    string
+	EnvironmentName string
+	VPNName         string
+	// NewEnvironmentName, EnvironmentDescription and ProjectId apply to an
+	// environment created for the machine.
+	NewEnvironmentName     string
+	EnvironmentDescription string
+	ProjectId              string
 }
 
 func NewDriver(hostName, storePath string) drivers.Driver {
@@ -87,23 +155,107 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Usage:  "Your secret security token",
 			EnvVar: "SKYTAP_API_SECURITY_TOKEN",
 		},
+		mcnflag.StringFlag{
+			Name:   "skytap-api-url",
+			Usage:  "Base URL of the Skytap API, for proxies, regional or on-premises endpoints",
+			Value:  skytapApiUrl,
+			EnvVar: "SKYTAP_API_URL",
+		},
+		mcnflag.IntFlag{
+			Name:   "skytap-api-max-retries",
+			Usage:  "Number of times to retry Skytap API requests that fail because of busy resources, rate limiting or server errors",
+			Value:  defaultApiMaxRetries,
+			EnvVar: "SKYTAP_API_MAX_RETRIES",
+		},
+		mcnflag.IntFlag{
+			Name:   "skytap-api-backoff",
+			Usage:  "Initial delay in seconds before retrying a failed Skytap API request, doubled on each retry",
+			Value:  defaultApiBackoff,
+			EnvVar: "SKYTAP_API_BACKOFF",
+		},
 		mcnflag.StringFlag{
 			Name:   "skytap-vm-id",
 			Usage:  "ID for the VM template to use",
 			EnvVar: "SKYTAP_VM_ID",
 		},
+		mcnflag.StringFlag{
+			Name:   "skytap-template-id",
+			Usage:  "ID of the template whose VM to use, instead of a source VM ID",
+			EnvVar: "SKYTAP_TEMPLATE_ID",
+		},
+		mcnflag.StringFlag{
+			Name:   "skytap-template-name",
+			Usage:  "Name of the template whose VM to use, instead of a source VM or template ID",
+			EnvVar: "SKYTAP_TEMPLATE_NAME",
+		},
+		mcnflag.StringFlag{
+			Name:   "skytap-template-vm-name",
+			Usage:  "Name of the VM to use in a template with several VMs",
+			EnvVar: "SKYTAP_TEMPLATE_VM_NAME",
+		},
 		mcnflag.StringFlag{
 			Name:   "skytap-env-id",
 			Usage:  "ID for the environment to add the VM to. Leave blank to create to a new environment",
 			Value:  defaultEnvironmentId,
 			EnvVar: "SKYTAP_ENV_ID",
 		},
+		mcnflag.StringFlag{
+			Name:   "skytap-env-name",
+			Usage:  "Name of the environment to add the VM to, instead of its ID",
+			EnvVar: "SKYTAP_ENV_NAME",
+		},
+		mcnflag.StringFlag{
+			Name:   "skytap-new-env-name",
+			Usage:  "Name of the environment created when no environment is selected. The default is docker-machine-<machine name>",
+			EnvVar: "SKYTAP_NEW_ENV_NAME",
+		},
+		mcnflag.StringFlag{
+			Name:   "skytap-env-description",
+			Usage:  "Description of the environment created when no environment is selected",
+			EnvVar: "SKYTAP_ENV_DESCRIPTION",
+		},
+		mcnflag.StringFlag{
+			Name:   "skytap-project-id",
+			Usage:  "ID of the project to add the environment created when no environment is selected to",
+			EnvVar: "SKYTAP_PROJECT_ID",
+		},
 		mcnflag.StringFlag{
 			Name:   "skytap-vpn-id",
 			Usage:  "VPN ID to connect to the environment",
 			Value:  defaultVPNId,
 			EnvVar: "SKYTAP_VPN_ID",
 		},
+		mcnflag.StringFlag{
+			Name:   "skytap-vpn-name",
+			Usage:  "Name of the VPN to connect to the environment, instead of its ID",
+			EnvVar: "SKYTAP_VPN_NAME",
+		},
+		mcnflag.StringFlag{
+			Name:   "skytap-network-id",
+			Usage:  "ID of the environment network to connect the VPN to, in an environment selected with --skytap-env-id or --skytap-env-name. The default is the first network",
+			EnvVar: "SKYTAP_NETWORK_ID",
+		},
+		mcnflag.StringFlag{
+			Name:   "skytap-network-name",
+			Usage:  "Name of the environment network to connect the VPN to. The default is the first network",
+			EnvVar: "SKYTAP_NETWORK_NAME",
+		},
+		mcnflag.IntFlag{
+			Name:   "skytap-interface-index",
+			Usage:  "Index of the VM network interface whose address is used to reach the machine",
+			Value:  0,
+			EnvVar: "SKYTAP_INTERFACE_INDEX",
+		},
+		mcnflag.StringFlag{
+			Name:   "skytap-icnr-target-network",
+			Usage:  "ID of a network outside the environment to connect to with an inter-configuration network route (ICNR), as an alternative to a VPN",
+			EnvVar: "SKYTAP_ICNR_TARGET_NETWORK",
+		},
+		mcnflag.StringFlag{
+			Name:   "skytap-public-ip",
+			Usage:  "Make the machine reachable from the internet: 'auto' attaches an available public IP, an address attaches that public IP, 'services' publishes the SSH and Docker ports",
+			EnvVar: "SKYTAP_PUBLIC_IP",
+		},
 		mcnflag.StringFlag{
 			Name:   "skytap-ssh-user",
 			Usage:  "SSH user",
@@ -112,7 +264,7 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 		},
 		mcnflag.StringFlag{
 			Name:   "skytap-ssh-key",
-			Usage:  "SSH private key path (if not provided, identities in ssh-agent will be used)",
+			Usage:  "SSH private key path (if not provided, identities in ssh-agent will be used, or the VM's stored password if ssh-agent is not running)",
 			Value:  "",
 			EnvVar: "SKYTAP_SSH_KEY",
 		},
@@ -143,35 +295,138 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Usage:  "The amount of ram, in megabytes, allocated to the VM. The default is what’s configured for the source VM.",
 			EnvVar: "SKYTAP_VM_RAM",
 		},
+		mcnflag.StringSliceFlag{
+			Name:   "skytap-vm-disk-size",
+			Usage:  "Size in megabytes of a disk to add to the VM. May be repeated",
+			EnvVar: "SKYTAP_VM_DISK_SIZE",
+		},
+		mcnflag.IntFlag{
+			Name:   "skytap-vm-primary-disk-size",
+			Usage:  "Size in megabytes to grow the VM's primary disk to. The guest file system is not grown",
+			EnvVar: "SKYTAP_VM_PRIMARY_DISK_SIZE",
+		},
+		mcnflag.BoolFlag{
+			Name:   "skytap-mount-docker-disk",
+			Usage:  "Partition and format the first added disk and mount it at /var/lib/docker",
+			EnvVar: "SKYTAP_MOUNT_DOCKER_DISK",
+		},
 		mcnflag.BoolFlag{
 			Name:   "skytap-container-host",
 			Usage:  "Configures the VM as a container host.",
 			EnvVar: "SKYTAP_CONTAINER_HOST",
 		},
+		mcnflag.StringSliceFlag{
+			Name:   "skytap-tag",
+			Usage:  "Tag to add to a new environment, such as key=value, in addition to tags recording the machine name and driver version. May be repeated",
+			EnvVar: "SKYTAP_TAG",
+		},
+		mcnflag.StringSliceFlag{
+			Name:   "skytap-label",
+			Usage:  "Label to add to the new VM and environment, as category=value. May be repeated",
+			EnvVar: "SKYTAP_LABEL",
+		},
+		mcnflag.IntFlag{
+			Name:   "skytap-create-timeout",
+			Usage:  "Maximum number of seconds to spend creating the machine",
+			Value:  defaultCreateTimeout,
+			EnvVar: "SKYTAP_CREATE_TIMEOUT",
+		},
+		mcnflag.IntFlag{
+			Name:   "skytap-ssh-timeout",
+			Usage:  "Maximum number of seconds to wait for SSH to become available on the new VM",
+			Value:  defaultSSHTimeout,
+			EnvVar: "SKYTAP_SSH_TIMEOUT",
+		},
+		mcnflag.IntFlag{
+			Name:   "skytap-phase-timeout",
+			Usage:  "Maximum number of seconds to spend on each step of creating or starting the machine, such as waiting for the environment to be ready or the VM to start",
+			Value:  defaultPhaseTimeout,
+			EnvVar: "SKYTAP_PHASE_TIMEOUT",
+		},
+		mcnflag.StringFlag{
+			Name:   "skytap-stop-mode",
+			Usage:  "How 'docker-machine stop' stops the VM: 'shutdown' shuts the guest OS down, powering the VM off if it has not stopped within the stop timeout, 'suspend' keeps its memory state so that start resumes it",
+			Value:  stopModeShutdown,
+			EnvVar: "SKYTAP_STOP_MODE",
+		},
+		mcnflag.IntFlag{
+			Name:   "skytap-stop-timeout",
+			Usage:  "Maximum number of seconds to wait for the guest OS to shut down before powering the VM off",
+			Value:  defaultStopTimeout,
+			EnvVar: "SKYTAP_STOP_TIMEOUT",
+		},
+		mcnflag.IntFlag{
+			Name:   "skytap-busy-wait",
+			Usage:  "Maximum number of seconds to wait for a busy VM to settle when reading its state, before reporting it as starting or stopping",
+			EnvVar: "SKYTAP_BUSY_WAIT",
+		},
+		mcnflag.IntFlag{
+			Name:   "skytap-state-cache-ttl",
+			Usage:  "Number of seconds the VM details and IP address last read from Skytap are reused before asking Skytap again, 0 to always ask",
+			Value:  defaultStateCacheTTL,
+			EnvVar: "SKYTAP_STATE_CACHE_TTL",
+		},
+		mcnflag.BoolFlag{
+			Name:   "skytap-keep-on-failure",
+			Usage:  "Keep partially created Skytap resources when create fails, for debugging.",
+			EnvVar: "SKYTAP_KEEP_ON_FAILURE",
+		},
 	}
 }
 
 func (d *Driver) PreCreateCheck() error {
   /*
 			The following checks are performed:
-			1. Check the source VM exists
-			2. Check the target environment exists; if adding the machine to an existing environment
-			3. Check the Machine name won't collide with an existing VM's hostname
-			4. If running outside Skytap ensure a VPN Id is provided
-			5. If VPN provided check it exists
+			1. Resolve the template, environment and VPN given by name to exactly one ID each
+			2. Check the source VM, or the template and its VM, exist
+			3. Check the target environment exists; if adding the machine to an existing environment, otherwise the project
+			   to add the new environment to, if any
+			4. Check the Machine name won't collide with an existing VM's hostname
+			5. If running outside Skytap ensure a VPN Id, ICNR target network or public IP is requested
+			6. If VPN provided check it exists
+			7. Check the selected network and interface exist
+			8. If a public IP is requested check one is available
+			9. Check the requested CPUs, RAM and disks fit the source VM's limits and the account's quotas
 	*/
 
 	d.SetLogLevel()
 	log.Debugf("Skytap client auth: %+v", d.ClientCredentials)
 
-	client := *api.NewSkytapClientFromCredentials(d.ClientCredentials)
+	client := d.client()
+
+	log.Debug("Resolving resources selected by name.")
+	if err := d.resolveNames(client); err != nil {
+		return err
+	}
 
 	log.Debug("Checking if source VM exists.")
-	vm, err := api.GetVirtualMachine(client, d.DeviceConfig.SourceVMId)
+	source, err := d.resolveSource(client)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Found VM %s.", source.vm.Id)
+	if err = d.checkInterfaceIndex(source.vm); err != nil {
+		return err
+	}
+
+	log.Debug("Checking requested hardware against the source VM and account quotas.")
+	hardware, err := getHardware(client, source)
 	if err != nil {
 		return err
 	}
-	log.Debugf("Found VM %s.", vm.Id)
+	if err = d.checkHardware(hardware); err != nil {
+		return err
+	}
+	if err = d.checkQuotas(client, hardware); err != nil {
+		return err
+	}
+
+	if d.DeviceConfig.EnvironmentId == defaultEnvironmentId && d.networkSelected() {
+		log.Debug("Checking the selected network against the source of the new environment.")
+		if err = d.checkSourceNetwork(client, source); err != nil {
+			return err
+		}
+	}
 
 	log.Debug("Checking if target environment exists.")
   if d.DeviceConfig.EnvironmentId != defaultEnvironmentId {
@@ -180,6 +435,11 @@ func (d *Driver) PreCreateCheck() error {
 			return err
 		}
 	  log.Debugf("Found environment %s.", env.Id)
+		if d.networkSelected() {
+			if _, err = d.selectNetwork(env); err != nil {
+				return err
+			}
+		}
 	  // Check if VM hostname already exists
 		for _, vm := range env.Vms {
 			log.Debugf("VM Name: %s", vm.Name)
@@ -192,11 +452,22 @@ func (d *Driver) PreCreateCheck() error {
 		}
 	}
 
-	// If we're running outside a Skytap VM a VPN connection is required.
+	if d.DeviceConfig.ProjectId != "" {
+		log.Debug("Checking if project exists.")
+		if err = checkProject(client, d.DeviceConfig.ProjectId); err != nil {
+			return err
+		}
+	}
+
+	// If we're running outside a Skytap VM a VPN connection or network route is required.
 	log.Debug("Checking if we require a VPN")
   resp := api.IsRunningInSkytap()
-	if resp == false && d.DeviceConfig.VPNId == "" {
-			return fmt.Errorf("When running Docker Machine outside Skytap a VPN is required.")
+	if resp == false && d.DeviceConfig.VPNId == "" && d.DeviceConfig.ICNRTargetNetworkId == "" && d.PublicIpMode == "" {
+			return fmt.Errorf("When running Docker Machine outside Skytap a VPN, ICNR target network or public IP is required.")
+	}
+
+	if err = d.checkPublicIp(client); err != nil {
+		return err
 	}
 
 	// Check if VPN exists
@@ -217,27 +488,59 @@ func (d *Driver) Create() error {
 	log.Info("Creating docker machine in Skytap")
 	log.Debugf("Skytap client auth: %+v", d.ClientCredentials)
 
-	client := *api.NewSkytapClientFromCredentials(d.ClientCredentials)
+	client := d.client()
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.createTimeout())
+	defer cancel()
 
+	rollback := &rollbackLog{}
+	err := d.create(ctx, client, rollback)
+	if err != nil {
+		if d.KeepOnFailure {
+			log.Warnf("Create failed, keeping partially created Skytap resources as requested: %s", err)
+		} else {
+			log.Warnf("Create failed, removing partially created Skytap resources: %s", err)
+			rollback.unwind()
+		}
+	}
+	return err
+}
+
+/*
+ Performs the steps of Create, recording each Skytap side effect in the rollback log as soon as it has happened.
+ Changes made to the new VM itself (NIC and VM names, hardware, container host) are not recorded since they go
+ away with the VM.
+*/
+func (d *Driver) create(ctx context.Context, client api.SkytapClient, rollback *rollbackLog) error {
 	var env *api.Environment = nil
 	var err error = nil
+	var vmId string
+	if err = d.resolveNames(client); err != nil {
+		return err
+	}
+	source, err := d.resolveSource(client)
+	if err != nil {
+		return err
+	}
 	if d.DeviceConfig.EnvironmentId == defaultEnvironmentId {
-		vm, err := api.GetVirtualMachine(client, d.DeviceConfig.SourceVMId)
-		if err != nil {
-			return err
-		}
-
-		template, err := vm.GetTemplate(client)
-		if err != nil {
-			return err
+		vm := source.vm
+		templateId := source.templateId
+		if templateId == "" {
+			template, err := vm.GetTemplate(client)
+			if err != nil {
+				return err
+			}
+			if template != nil {
+				templateId = template.Id
+			}
 		}
 
-		if template != nil {
-			env, err = api.CreateNewEnvironmentWithVms(client, template.Id, []string{vm.Id})
-			if err != nil {
+		err = runPhase(ctx, phaseNewEnvironment, d.phaseTimeout(), func(ctx context.Context) error {
+			client := withContext(ctx, client)
+			if templateId != "" {
+				env, err = api.CreateNewEnvironmentWithVms(client, templateId, []string{vm.Id})
 				return err
 			}
-		} else {
 			sourceEnv, err := vm.GetEnvironment(client)
 			if err != nil {
 				return err
@@ -246,117 +549,210 @@ func (d *Driver) Create() error {
 				return fmt.Errorf("VM not associated with template or environment, don't know how to build new environment with VM")
 			}
 			env, err = api.CopyEnvironmentWithVms(client, sourceEnv.Id, []string{vm.Id})
-			if err != nil {
-				return err
-			}
+			return err
+		})
+		if err != nil {
+			return err
 		}
 
 		d.DeviceConfig.EnvironmentId = env.Id
-		env, err = env.WaitUntilReady(client)
+		d.OwnsEnvironment = true
+		envId := env.Id
+		rollback.add("create environment "+envId, func() error {
+			created, err := api.GetEnvironment(client, envId)
+			if err != nil {
+				return err
+			}
+			if err = removeEnvironment(client, created); err != nil {
+				return err
+			}
+			d.DeviceConfig.EnvironmentId = defaultEnvironmentId
+			d.OwnsEnvironment = false
+			return nil
+		})
 
-		if err != nil {
+		if len(env.Vms) != 1 {
+			return fmt.Errorf("Expected new environment %s to contain one VM, found %d", env.Id, len(env.Vms))
+		}
+		vmId = env.Vms[0].Id
+		if err = d.describeEnvironment(client, envId); err != nil {
 			return err
 		}
 	} else {
-		env, err = api.GetEnvironment(client, d.DeviceConfig.EnvironmentId)
+		// Other machines may be adding VMs to the same environment, so the
+		// new VM is told apart by comparing the environment's VMs before and
+		// after adding it, with the lock held so that no other machine from
+		// this store adds one in between.
+		unlock, err := d.lockEnvironment(ctx, d.DeviceConfig.EnvironmentId)
 		if err != nil {
 			return err
 		}
-		env, err = env.WaitUntilReady(client)
+		err = runPhase(ctx, phaseEnvironmentReady, d.phaseTimeout(), func(ctx context.Context) error {
+			env, err = waitForEnvironment(ctx, client, d.DeviceConfig.EnvironmentId)
+			return err
+		})
 		if err != nil {
+			unlock()
 			return err
 		}
-		env, err = env.AddVirtualMachine(client, d.DeviceConfig.SourceVMId)
+		existing := vmIds(env)
+		if source.templateId != "" {
+			env, err = addTemplateVm(client, env.Id, source.templateId, source.vm.Id)
+		} else {
+			env, err = env.AddVirtualMachine(client, source.vm.Id)
+		}
+		unlock()
 		if err != nil {
 			return err
 		}
+		added := addedVmIds(existing, env)
+		if len(added) != 1 {
+			// The VM was added, but cannot be told apart from those another
+			// machine added at the same time. None of them is deleted, since
+			// any of them may belong to the other machine.
+			return fmt.Errorf("Unable to identify the VM added to environment %s, found %d new VMs: %v. "+
+				"None of them was removed, delete the one created for this machine manually", env.Id, len(added), added)
+		}
+		addedId := added[0]
+		vmId = addedId
+		rollback.add("add VM "+addedId+" to environment "+env.Id, func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), d.phaseTimeout())
+			defer cancel()
+			if _, err := waitForVm(ctx, client, addedId); err != nil {
+				return err
+			}
+			return api.DeleteVirtualMachine(client, addedId)
+		})
+	}
+
+	err = runPhase(ctx, phaseEnvironmentReady, d.phaseTimeout(), func(ctx context.Context) error {
+		env, err = waitForEnvironment(ctx, client, env.Id)
+		return err
+	})
+	if err != nil {
+		return err
 	}
 
-	//TODO: Multiple networks?
 	vpnId := d.DeviceConfig.VPNId
 	if vpnId != "" {
-		attached := false
-		for _, network := range env.Networks {
-			// Look to see if there is an attached VPN that we simply need to connect
-			for _, attachment := range network.VpnAttachments {
-				if attachment.Vpn.Id == vpnId {
-					attached = true
-					if !attachment.Connected {
-						if err = network.ConnectToVpn(client, env.Id, vpnId); err != nil {
-							return err
-						}
-					}
-					break
-				}
+		err = runPhase(ctx, phaseVpnConnect, d.phaseTimeout(), func(ctx context.Context) error {
+			unlock, err := d.lockEnvironment(ctx, env.Id)
+			if err != nil {
+				return err
+			}
+			defer unlock()
+			if err := d.connectVpn(client, env, rollback); err != nil {
+				return err
 			}
+			if err := sleepContext(ctx, 2*time.Second); err != nil {
+				return err
+			}
+			env, err = waitForEnvironment(ctx, client, env.Id)
+			return err
+		})
+		if err != nil {
+			return err
 		}
-		if !attached {
-			_, err := env.Networks[0].AttachToVpn(client, env.Id, vpnId)
+	}
+
+	if d.DeviceConfig.ICNRTargetNetworkId != "" {
+		err = runPhase(ctx, phaseIcnrConnect, d.phaseTimeout(), func(ctx context.Context) error {
+			unlock, err := d.lockEnvironment(ctx, env.Id)
 			if err != nil {
 				return err
 			}
-			if err = env.Networks[0].ConnectToVpn(client, env.Id, vpnId); err != nil {
+			defer unlock()
+			if err := d.connectIcnr(client, env, rollback); err != nil {
 				return err
 			}
-		}
-		env, err = env.WaitUntilReady(client)
+			env, err = waitForEnvironment(ctx, client, env.Id)
+			return err
+		})
 		if err != nil {
 			return err
 		}
 	}
 
-	sleepTime := 2 * time.Second
-	time.Sleep(sleepTime)
-
-	env, err = env.WaitUntilReady(client)
-	if err != nil {
-		return err
+	vm := findVm(env, vmId)
+	if vm == nil {
+		return fmt.Errorf("VM %s is no longer in environment %s", vmId, env.Id)
 	}
-
-	vm := env.Vms[len(env.Vms)-1]
-	vm, err = vm.WaitUntilReady(client)
-	if err != nil {
+	if err = d.checkInterfaceIndex(vm); err != nil {
 		return err
 	}
+	nicIndex := d.DeviceConfig.InterfaceIndex
 
 	// Rename interface to match name of machine from docker-machine's perspective.
 	log.Infof("Naming network interface")
-	_, err = vm.RenameNetworkInterface(client, env.Id, vm.Interfaces[0].Id, d.MachineName)
-	if err != nil {
-		sleepTime := 10 * time.Second
-		log.Infof("Got error renaming NIC, sleeping %s and trying again.", sleepTime)
-		time.Sleep(sleepTime)
-		vm, err = vm.WaitUntilReady(client)
-		if err != nil {
-			return err
-		}
-		_, err = vm.RenameNetworkInterface(client, env.Id, vm.Interfaces[0].Id, d.MachineName)
-		if err != nil {
-			log.Infof("Unable to rename NIC to '%s', check that name is not already in use by another VM.", d.MachineName)
-			return err
+	err = runPhase(ctx, phaseNicRename, d.phaseTimeout(), func(ctx context.Context) error {
+		client := withContext(ctx, client)
+		for attempt := 1; ; attempt++ {
+			vm, err = waitForVm(ctx, client, vm.Id)
+			if err != nil {
+				return err
+			}
+			_, err = vm.RenameNetworkInterface(client, env.Id, vm.Interfaces[nicIndex].Id, d.MachineName)
+			if err == nil || ctx.Err() != nil {
+				return err
+			}
+			if attempt == nicRenameAttempts {
+				log.Infof("Unable to rename NIC to '%s', check that name is not already in use by another VM.", d.MachineName)
+				return err
+			}
+			delay := 2 * pollInterval
+			log.Infof("Got error renaming NIC, sleeping %s and trying again: %s", delay, err)
+			if err = sleepContext(ctx, delay); err != nil {
+				return err
+			}
 		}
+	})
+	if err != nil {
+		return err
 	}
 
 	// Also set VM name to the docker-machine name
 	log.Infof("Naming VM")
-	vm, err = vm.SetName(client, d.MachineName)
+	err = runPhase(ctx, phaseVmName, d.phaseTimeout(), func(ctx context.Context) error {
+		vm, err = vm.SetName(withContext(ctx, client), d.MachineName)
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
+	if err = d.exposePublicly(client, env.Id, vm, vm.Interfaces[nicIndex].Id, rollback); err != nil {
+		return err
+	}
+
+	if err = d.applyTags(client, env.Id, vm.Id); err != nil {
+		return err
+	}
+
 	// Change hardware options if requested
 	if d.HardwareConfig != nil {
 		log.Infof("Updating hardware")
-		vm, err = vm.UpdateHardware(client, *d.HardwareConfig, false)
+		err = runPhase(ctx, phaseHardware, d.phaseTimeout(), func(ctx context.Context) error {
+			vm, err = vm.UpdateHardware(withContext(ctx, client), *d.HardwareConfig, false)
+			return err
+		})
 		if err != nil {
 			return err
 		}
 	}
+	err = runPhase(ctx, phaseDisks, d.phaseTimeout(), func(ctx context.Context) error {
+		return d.provisionDisks(withContext(ctx, client), env.Id, vm.Id)
+	})
+	if err != nil {
+		return err
+	}
 
   // Mark as container host if requested
   if d.ContainerHost == true {
 		log.Infof("Configuring VM as a container host")
-		vm, err = vm.SetContainerHost(client)
+		err = runPhase(ctx, phaseContainerHost, d.phaseTimeout(), func(ctx context.Context) error {
+			vm, err = vm.SetContainerHost(withContext(ctx, client))
+			return err
+		})
 		if err != nil {
 			return err
 		}
@@ -366,35 +762,117 @@ func (d *Driver) Create() error {
 		log.Infof("# docker run -itd --name=skytap_agent --restart=always -v /var/run/docker.sock:/var/run/docker.sock skytap/agent")
 	}
 
-	// Just added a VM so pick the last one
 	log.Infof("Starting ...")
-	started, err := vm.Start(client)
+	err = runPhase(ctx, phaseStart, d.phaseTimeout(), func(ctx context.Context) error {
+		vm, err = waitForVm(ctx, client, vm.Id)
+		if err != nil {
+			return err
+		}
+		d.LastAction = actionStart
+		started, err := vm.Start(client)
+		if err != nil {
+			return err
+		}
+		rollback.add("start VM "+started.Id, func() error {
+			killed, err := started.Kill(client)
+			if err != nil {
+				return err
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), d.phaseTimeout())
+			defer cancel()
+			_, err = waitForVm(ctx, client, killed.Id)
+			return err
+		})
+		vm, err = waitForVm(ctx, client, started.Id)
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
-	renamed, err := started.WaitUntilReady(client)
+	d.Vm = *vm
+
+	if err = d.refreshIpAddress(); err != nil {
+		return err
+	}
+
+	log.Infof("Generating SSH key and deploying")
+	rollback.add("install SSH key "+d.GetSSHKeyPath(), func() error {
+		return removeSshKeyFiles(d.GetSSHKeyPath())
+	})
+	err = runPhase(ctx, phaseSSH, d.sshTimeout(), func(ctx context.Context) error {
+		return installSshKey(d, ctx)
+	})
 	if err != nil {
 		return err
 	}
 
-	d.Vm = *renamed
+	if d.MountDockerDisk {
+		return d.mountDockerDisk()
+	}
+	return nil
+}
 
-	if err = d.refreshIpAddress(); err != nil {
+/*
+ Attaches and connects the configured VPN to the selected network of the environment. An existing attachment is
+ reused; when no network was selected explicitly, one on any of the environment's networks will do.
+*/
+func (d *Driver) connectVpn(client api.SkytapClient, env *api.Environment, rollback *rollbackLog) error {
+	vpnId := d.DeviceConfig.VPNId
+	selected, err := d.selectNetwork(env)
+	if err != nil {
 		return err
 	}
+	for i, network := range env.Networks {
+		if d.networkSelected() && i != selected {
+			continue
+		}
+		// Look to see if there is an attached VPN that we simply need to connect
+		for _, attachment := range network.VpnAttachments {
+			if attachment.Vpn.Id == vpnId {
+				if !attachment.Connected {
+					if err := network.ConnectToVpn(client, env.Id, vpnId); err != nil {
+						return err
+					}
+					rollback.add("connect VPN "+vpnId, disconnectVpnStep(client, env.Id, network.Id, vpnId))
+				}
+				return nil
+			}
+		}
+	}
 
-	log.Infof("Generating SSH key and deploying")
-	err = d.GenerateSshKeyAndCopy()
+	_, err = env.Networks[selected].AttachToVpn(client, env.Id, vpnId)
 	if err != nil {
 		return err
 	}
+	networkId := env.Networks[selected].Id
+	rollback.add("attach VPN "+vpnId, func() error {
+		return detachVpn(client, env.Id, networkId, vpnId)
+	})
+	if err = env.Networks[selected].ConnectToVpn(client, env.Id, vpnId); err != nil {
+		return err
+	}
+	rollback.add("connect VPN "+vpnId, disconnectVpnStep(client, env.Id, networkId, vpnId))
+	return nil
+}
+
+func disconnectVpnStep(client api.SkytapClient, envId, networkId, vpnId string) func() error {
+	return func() error {
+		return disconnectVpn(client, envId, networkId, vpnId)
+	}
+}
 
+func removeSshKeyFiles(keyPath string) error {
+	for _, path := range []string{keyPath, keyPath + ".pub"} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
 	return nil
 }
 
 func (d *Driver) refreshVm() error {
-	client := *api.NewSkytapClientFromCredentials(d.ClientCredentials)
+	client := d.client()
 	vm, err := api.GetVirtualMachine(client, d.Vm.Id)
 	if err != nil {
 		return err
@@ -403,11 +881,28 @@ func (d *Driver) refreshVm() error {
 	return nil
 }
 
+/*
+ Reports whether the VM details and IP address were read from Skytap within the state cache TTL.
+*/
+func (d *Driver) resolvedRecently() bool {
+	if d.StateCacheTTL <= 0 || d.ResolvedAt.IsZero() {
+		return false
+	}
+	return time.Since(d.ResolvedAt) < time.Duration(d.StateCacheTTL)*time.Second
+}
+
 func (d *Driver) refreshIpAddress() error {
-	//TODO: What about multiple interfaces?
-	if d.DeviceConfig.VPNId != defaultVPNId {
+	if err := d.checkInterfaceIndex(&d.Vm); err != nil {
+		return err
+	}
+	nic := d.Vm.Interfaces[d.DeviceConfig.InterfaceIndex]
+	if host, _, ok := d.publishedAddress(d.SSHPort); ok {
+		d.IPAddress = host
+	} else if d.PublicIp != "" {
+		d.IPAddress = d.PublicIp
+	} else if d.DeviceConfig.VPNId != defaultVPNId {
 		var correctNat api.VpnNatAddress
-		for _, a := range d.Vm.Interfaces[0].NatAddresses.VpnNatAddresses {
+		for _, a := range nic.NatAddresses.VpnNatAddresses {
 			if a.VpnId == d.DeviceConfig.VPNId {
 				correctNat = a
 			}
@@ -416,27 +911,122 @@ func (d *Driver) refreshIpAddress() error {
 			return errors.New(fmt.Sprintf("Unable to find network NAT address for correct VPN in VM %s", d.Vm.Id))
 		}
 		d.IPAddress = correctNat.IpAddress
+	} else if d.DeviceConfig.ICNRTargetNetworkId != "" {
+		ip, err := d.icnrAddress(d.client(), nic.Id, nic.Ip)
+		if err != nil {
+			return err
+		}
+		d.IPAddress = ip
 	} else {
-		d.IPAddress = d.Vm.Interfaces[0].Ip
+		d.IPAddress = nic.Ip
 	}
+	d.ResolvedAt = time.Now()
 	return nil
 }
 
 /*
- Generates a new SSH keypair, uses password auth to create the .ssh/authorized_keys file for later docker-machine access.
+ Makes docker-machine's SSH key usable on the VM. A key supplied with --skytap-ssh-key is copied into the machine
+ store and used directly; otherwise a new keypair is generated and its public key is added to the
+ .ssh/authorized_keys file over a connection authenticated by ssh-agent or the VM's stored password.
 */
-func (d *Driver) GenerateSshKeyAndCopy() error {
+func (d *Driver) GenerateSshKeyAndCopy(ctx context.Context) error {
 	d.SetLogLevel()
-	client := *api.NewSkytapClientFromCredentials(d.ClientCredentials)
-	creds, err := d.Vm.GetCredentials(client)
+	if d.SSHKey != "" {
+		return d.useProvidedSshKey(ctx)
+	}
+
+	client := d.client()
+	auth, err := d.bootstrapAuthMethods(client)
+	if err != nil {
+		return err
+	}
+
+	err = d.retrySsh(ctx, func() error {
+		return d.DoSshCopy(auth)
+	})
 	if err != nil {
+		log.Infof("Unable to SSH to target machine to copy public key credentials after retries: %s", err)
 		return err
 	}
+	return nil
+}
+
+/*
+ Copies the private key given with --skytap-ssh-key (and its public half) into the machine store and checks the VM
+ accepts it. The VM's stored credentials are never consulted, so this works on templates with password auth disabled.
+*/
+func (d *Driver) useProvidedSshKey(ctx context.Context) error {
+	signer, err := readSshSigner(d.SSHKey)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Copying SSH key %s into the machine store", d.SSHKey)
+	if err = mcnutils.CopyFile(d.SSHKey, d.GetSSHKeyPath()); err != nil {
+		return err
+	}
+	if err = os.Chmod(d.GetSSHKeyPath(), 0600); err != nil {
+		return err
+	}
+	pubKeyFile := d.GetSSHKeyPath() + ".pub"
+	if _, err = os.Stat(d.SSHKey + ".pub"); err == nil {
+		err = mcnutils.CopyFile(d.SSHKey+".pub", pubKeyFile)
+	} else {
+		err = ioutil.WriteFile(pubKeyFile, ssh.MarshalAuthorizedKey(signer.PublicKey()), 0644)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = d.retrySsh(ctx, func() error {
+		sshClient, err := d.dialSsh([]ssh.AuthMethod{ssh.PublicKeys(signer)})
+		if err != nil {
+			log.Infof("Error connecting with SSH key %s: %s", d.SSHKey, err)
+			return err
+		}
+		defer sshClient.Close()
+		return runRemoteBashCommand(sshClient, "exit 0")
+	})
+	if err != nil {
+		log.Infof("Unable to SSH to target machine with key %s after retries: %s", d.SSHKey, err)
+		return err
+	}
+	return nil
+}
+
+/*
+ Returns the authentication methods used to install docker-machine's public key. Identities held by ssh-agent are
+ used when it is running, and the VM's stored credentials are then never looked up, so that templates with password
+ auth disabled work. Without ssh-agent the VM's stored password for the SSH user is used.
+*/
+func (d *Driver) bootstrapAuthMethods(client api.SkytapClient) ([]ssh.AuthMethod, error) {
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err == nil {
+			log.Debugf("Using identities from ssh-agent at %s", sock)
+			return []ssh.AuthMethod{ssh.PublicKeysCallback(agent.NewClient(conn).Signers)}, nil
+		}
+		log.Debugf("Unable to connect to ssh-agent at %s: %s", sock, err)
+	}
+
+	password, err := d.storedPassword(client)
+	if err != nil {
+		return nil, err
+	}
+	return []ssh.AuthMethod{ssh.Password(password)}, nil
+}
+
+// storedPassword returns the password Skytap stores for the SSH user in the VM's credentials.
+func (d *Driver) storedPassword(client api.SkytapClient) (string, error) {
+	creds, err := d.Vm.GetCredentials(client)
+	if err != nil {
+		return "", err
+	}
 	var foundCred *api.VmCredential
 	for _, c := range creds {
 		user, err := c.Username()
 		if err != nil {
-			return err
+			return "", err
 		}
 		if user == d.SSHUser {
 			foundCred = &c
@@ -444,47 +1034,66 @@ func (d *Driver) GenerateSshKeyAndCopy() error {
 		}
 	}
 	if foundCred == nil {
-		return fmt.Errorf("Virtual machine does not have credentials stored for specified SSH user %s", d.SSHUser)
+		return "", fmt.Errorf("Virtual machine does not have credentials stored for specified SSH user %s", d.SSHUser)
 	}
 
-	password, err := foundCred.Password()
-	if err != nil {
-		return err
-	}
+	return foundCred.Password()
+}
 
-	success := false
-	for i := 0; i < 5 && !success; i++ {
-		sleepTime := 10 * time.Second
-		log.Infof("Sleeping for %s, so that SSH services can come up properly", sleepTime)
-		time.Sleep(sleepTime)
+// retrySsh runs an SSH operation until it succeeds or the context is done, giving the VM's SSH service time to come up.
+func (d *Driver) retrySsh(ctx context.Context, operation func() error) error {
+	var err error
+	for {
+		log.Infof("Sleeping for %s, so that SSH services can come up properly", sshRetryInterval)
+		if ctxErr := sleepContext(ctx, sshRetryInterval); ctxErr != nil {
+			if err == nil {
+				err = ctxErr
+			}
+			return err
+		}
 
-		err = d.DoSshCopy(client, password)
-		if err != nil {
-			log.Warnf("Error attempting to connect to SSH, will retry %d times: %s", 5-i, err)
-		} else {
-			success = true
+		if err = operation(); err == nil {
+			return nil
 		}
+		log.Warnf("Error attempting to connect to SSH, will retry: %s", err)
 	}
-	if !success {
-		log.Infof("Unable to SSH to target machine to copy public key credentials after retries: %s", err)
-		return err
+}
+
+func (d *Driver) dialSsh(auth []ssh.AuthMethod) (*ssh.Client, error) {
+	port, err := d.GetSSHPort()
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	// The VM was just created, so there is no known host key to check, as
+	// with docker-machine's own SSH client.
+	return ssh.Dial("tcp", fmt.Sprintf("%s:%d", d.IPAddress, port), &ssh.ClientConfig{
+		User:            d.SSHUser,
+		Auth:            auth,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
 }
 
-func (d *Driver) DoSshCopy(client api.SkytapClient, password string) error {
+func readSshSigner(keyPath string) (ssh.Signer, error) {
+	key, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse SSH private key %s: %s", keyPath, err)
+	}
+	return signer, nil
+}
 
-	sshClient, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", d.IPAddress, d.SSHPort), &ssh.ClientConfig{
-		User: d.SSHUser,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(password),
-		},
-	})
+func (d *Driver) DoSshCopy(auth []ssh.AuthMethod) error {
+
+	sshClient, err := d.dialSsh(auth)
 
 	if err != nil {
-		log.Infof("Error connecting with password credentials: %s", err)
+		log.Infof("Error connecting to install public key credentials: %s", err)
 		return err
 	}
+	defer sshClient.Close()
 
 	if err = runRemoteBashCommand(sshClient, "mkdir -p ~/.ssh"); err != nil {
 		log.Infof("Error ensuring existence of ~/.ssh directory: %s", err)
@@ -553,14 +1162,26 @@ func (d *Driver) GetURL() (string, error) {
 	// only return a valid URL if we believe we are running
 	if d.LastState == state.Running {
 		d.SetLogLevel()
-		d.refreshVm()
-		d.refreshIpAddress()
+		if !d.resolvedRecently() && d.StateCacheTTL > 0 {
+			d.loadStateCache()
+		}
+		if !d.resolvedRecently() {
+			if err := d.refreshVm(); err != nil {
+				return "", err
+			}
+			if err := d.refreshIpAddress(); err != nil {
+				return "", err
+			}
+			if d.StateCacheTTL > 0 {
+				d.saveStateCache()
+			}
+		}
 		ip, err := d.GetIP()
 		if err != nil {
 			return "", err
 		}
 		if d.Vm.Runstate == api.RunStateStart {
-			return fmt.Sprintf("tcp://%s:2376", ip), nil
+			return fmt.Sprintf("tcp://%s", d.dockerAddress(ip)), nil
 		} else {
 			return "", nil
 		}
@@ -571,47 +1192,175 @@ func (d *Driver) GetURL() (string, error) {
 
 func (d *Driver) GetState() (state.State, error) {
 	d.SetLogLevel()
-	client := *api.NewSkytapClientFromCredentials(d.ClientCredentials)
-	vm, err := api.GetVirtualMachine(client, d.Vm.Id)
+	client := d.client()
+	vm, err := d.settledVm(client)
 	if err != nil {
 		return state.None, err
 	}
-	switch vm.Runstate {
-	case api.RunStateBusy:
-		d.LastState = state.None
-		return state.None, errors.New("VM is busy, wait and try again")
-	case api.RunStateStop:
-		d.LastState = state.Stopped
-		return state.Stopped, nil
-	case api.RunStateStart:
-		d.LastState = state.Running
-		return state.Running, nil
-	case api.RunStatePause:
-		d.LastState = state.Paused
-		return state.Paused, nil
-	default:
-		d.LastState = state.None
-		return state.None, errors.New("Unhandled VM state: " + vm.Runstate)
-	}
+	d.LastState = d.vmState(vm.Runstate)
+	return d.LastState, nil
 }
 
 func (d *Driver) Kill() error {
 	d.SetLogLevel()
-	client := *api.NewSkytapClientFromCredentials(d.ClientCredentials)
+	client := d.client()
 
+	d.LastAction = actionStop
 	_, err := d.Vm.Kill(client)
 	return err
 }
 
 func (d *Driver) Remove() error {
 	d.SetLogLevel()
-	client := *api.NewSkytapClientFromCredentials(d.ClientCredentials)
-	err := api.DeleteVirtualMachine(client, d.Vm.Id)
-	return err
+	client := d.client()
+
+	if err := d.releasePublicAccess(client); err != nil {
+		return err
+	}
+
+	// Only environments and routes created by this driver are ever deleted, and
+	// only once this machine is the last VM left in the environment. Holding
+	// the lock keeps machines removed in parallel from each deciding that
+	// another one is last.
+	ctx, cancel := context.WithTimeout(context.Background(), d.phaseTimeout())
+	defer cancel()
+	unlock, err := d.lockEnvironment(ctx, d.DeviceConfig.EnvironmentId)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Each step treats a resource that no longer exists as already deleted,
+	// so that removing a machine whose removal failed part way, or whose
+	// resources were deleted in the Skytap UI, finishes the job.
+	if d.OwnsEnvironment || d.ICNRTunnelId != "" {
+		env, err := getEnvironment(client, d.DeviceConfig.EnvironmentId)
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+		last := env == nil || !hasOtherVms(env, d.Vm.Id)
+		if last && d.ICNRTunnelId != "" {
+			log.Infof("Deleting ICNR tunnel %s created for this machine", d.ICNRTunnelId)
+			if err = deleteTunnel(client, d.ICNRTunnelId); err != nil && !isNotFound(err) {
+				return err
+			}
+			d.ICNRTunnelId = ""
+		}
+		if env == nil {
+			log.Infof("Environment %s no longer exists", d.DeviceConfig.EnvironmentId)
+			return nil
+		}
+		if last && d.OwnsEnvironment {
+			log.Infof("Deleting environment %s created for this machine", env.Id)
+			return removeEnvironment(client, env)
+		}
+		if d.OwnsEnvironment {
+			log.Infof("Environment %s still contains other VMs, removing only this machine's VM", env.Id)
+		}
+	}
+
+	if err := deleteVm(client, d.Vm.Id); err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func hasOtherVms(env *api.Environment, vmId string) bool {
+	for _, vm := range env.Vms {
+		if vm.Id != vmId {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ Names and describes an environment created for this machine, and adds it to the selected project, so that it can
+ be told apart from the template or environment it was copied from.
+*/
+func (d *Driver) describeEnvironment(client api.SkytapClient, envId string) error {
+	params := map[string]string{"name": d.newEnvironmentName()}
+	if d.DeviceConfig.EnvironmentDescription != "" {
+		params["description"] = d.DeviceConfig.EnvironmentDescription
+	}
+	log.Infof("Naming environment %s '%s'", envId, params["name"])
+	if err := updateEnvironment(client, envId, params); err != nil {
+		return err
+	}
+
+	if d.DeviceConfig.ProjectId != "" {
+		log.Infof("Adding environment %s to project %s", envId, d.DeviceConfig.ProjectId)
+		return addEnvironmentToProject(client, d.DeviceConfig.ProjectId, envId)
+	}
+	return nil
+}
+
+func (d *Driver) newEnvironmentName() string {
+	if d.DeviceConfig.NewEnvironmentName != "" {
+		return d.DeviceConfig.NewEnvironmentName
+	}
+	return "docker-machine-" + d.MachineName
+}
+
+func vmIds(env *api.Environment) map[string]bool {
+	ids := map[string]bool{}
+	for _, vm := range env.Vms {
+		ids[vm.Id] = true
+	}
+	return ids
+}
+
+/*
+ Returns the IDs of the VMs in env that are not among the existing IDs. More than one means another machine added a
+ VM at the same time, from outside this machine store, and which one is ours cannot be told.
+*/
+func addedVmIds(existing map[string]bool, env *api.Environment) []string {
+	var added []string
+	for _, vm := range env.Vms {
+		if !existing[vm.Id] {
+			added = append(added, vm.Id)
+		}
+	}
+	return added
+}
+
+func findVm(env *api.Environment, vmId string) *api.VirtualMachine {
+	for _, vm := range env.Vms {
+		if vm.Id == vmId {
+			return vm
+		}
+	}
+	return nil
+}
+
+/*
+ Disconnects and detaches every VPN attached to the environment's networks, then deletes the environment
+ along with all of its VMs.
+*/
+func removeEnvironment(client api.SkytapClient, env *api.Environment) error {
+	for _, network := range env.Networks {
+		for _, attachment := range network.VpnAttachments {
+			if attachment.Connected {
+				log.Debugf("Disconnecting VPN %s from network %s", attachment.Vpn.Id, network.Id)
+				if err := disconnectVpn(client, env.Id, network.Id, attachment.Vpn.Id); err != nil && !isNotFound(err) {
+					return err
+				}
+			}
+			log.Debugf("Detaching VPN %s from network %s", attachment.Vpn.Id, network.Id)
+			if err := detachVpn(client, env.Id, network.Id, attachment.Vpn.Id); err != nil && !isNotFound(err) {
+				return err
+			}
+		}
+	}
+	if err := deleteEnvironment(client, env.Id); err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
 }
 
 func (d *Driver) Restart() error {
-	if err := d.Stop(); err != nil {
+	// Suspending and resuming would not restart anything, so always shut down.
+	if err := d.stop(stopModeShutdown); err != nil {
 		return err
 	}
 	return d.Start()
@@ -621,21 +1370,76 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	user := flags.String("skytap-user-id")
 	key := flags.String("skytap-api-security-token")
 	d.ClientCredentials = api.SkytapCredentials{user, key}
+	d.ApiUrl = flags.String("skytap-api-url")
+	if d.ApiUrl != "" {
+		if _, err := parseApiUrl(d.ApiUrl); err != nil {
+			return err
+		}
+	}
+	d.ApiMaxRetries = flags.Int("skytap-api-max-retries")
+	d.ApiBackoff = flags.Int("skytap-api-backoff")
+	if d.ApiMaxRetries < 0 || d.ApiBackoff < 0 {
+		return fmt.Errorf("API retries and backoff must not be negative")
+	}
 
 	d.SetSwarmConfigFromFlags(flags)
 	d.SSHUser = flags.String("skytap-ssh-user")
 	d.SSHPort = flags.Int("skytap-ssh-port")
+	d.SSHKey = flags.String("skytap-ssh-key")
+	if d.SSHKey != "" {
+		if _, err := os.Stat(d.SSHKey); err != nil {
+			return fmt.Errorf("Unable to read SSH key %s: %s", d.SSHKey, err)
+		}
+	}
 
 	envId := flags.String("skytap-env-id")
 	if envId == "" {
 		envId = defaultEnvironmentId
 	}
 	d.DeviceConfig = deviceConfig{
-		SourceVMId:    flags.String("skytap-vm-id"),
-		EnvironmentId: envId,
-		VPNId:         flags.String("skytap-vpn-id"),
+		SourceVMId:             flags.String("skytap-vm-id"),
+		TemplateId:             flags.String("skytap-template-id"),
+		TemplateVMName:         flags.String("skytap-template-vm-name"),
+		TemplateName:           flags.String("skytap-template-name"),
+		EnvironmentId:          envId,
+		EnvironmentName:        flags.String("skytap-env-name"),
+		NewEnvironmentName:     flags.String("skytap-new-env-name"),
+		EnvironmentDescription: flags.String("skytap-env-description"),
+		ProjectId:              flags.String("skytap-project-id"),
+		VPNId:                  flags.String("skytap-vpn-id"),
+		VPNName:                flags.String("skytap-vpn-name"),
+		NetworkId:              flags.String("skytap-network-id"),
+		NetworkName:            flags.String("skytap-network-name"),
+		InterfaceIndex:         flags.Int("skytap-interface-index"),
+		ICNRTargetNetworkId:    flags.String("skytap-icnr-target-network"),
 	}
 	d.ContainerHost = flags.Bool("skytap-container-host")
+	d.KeepOnFailure = flags.Bool("skytap-keep-on-failure")
+	d.PublicIpMode = flags.String("skytap-public-ip")
+	d.StopMode = flags.String("skytap-stop-mode")
+	d.StopTimeout = flags.Int("skytap-stop-timeout")
+	d.BusyWait = flags.Int("skytap-busy-wait")
+	d.StateCacheTTL = flags.Int("skytap-state-cache-ttl")
+	d.Tags = flags.StringSlice("skytap-tag")
+	if len(d.Tags) > 0 && (d.DeviceConfig.EnvironmentId != defaultEnvironmentId || d.DeviceConfig.EnvironmentName != "") {
+		return errors.New("Tags only apply when no environment is selected, as Skytap only tags environments")
+	}
+	d.Labels = flags.StringSlice("skytap-label")
+	if _, err := parseLabels(d.Labels); err != nil {
+		return err
+	}
+	if err := validateStopMode(d.StopMode); err != nil {
+		return err
+	}
+	if d.PublicIpMode != "" && d.PublicIpMode != publicIpAuto && d.PublicIpMode != publicIpServices && net.ParseIP(d.PublicIpMode) == nil {
+		return fmt.Errorf("Invalid public IP option '%s', must be '%s', '%s' or an IP address", d.PublicIpMode, publicIpAuto, publicIpServices)
+	}
+	d.CreateTimeout = flags.Int("skytap-create-timeout")
+	d.SSHTimeout = flags.Int("skytap-ssh-timeout")
+	d.PhaseTimeout = flags.Int("skytap-phase-timeout")
+	if d.CreateTimeout < 0 || d.SSHTimeout < 0 || d.PhaseTimeout < 0 {
+		return fmt.Errorf("Timeouts must not be negative")
+	}
 	cpus := flags.Int("skytap-vm-cpus")
 	cpuspersocket := flags.Int("skytap-vm-cpuspersocket")
 	ram := flags.Int("skytap-vm-ram")
@@ -654,13 +1458,25 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 		hc.Ram = &ram
 	}
 
+	diskSizes, err := parseDiskSizes(flags.StringSlice("skytap-vm-disk-size"))
+	if err != nil {
+		return err
+	}
+	d.DiskSizes = diskSizes
+	d.PrimaryDiskSize = flags.Int("skytap-vm-primary-disk-size")
+	if d.PrimaryDiskSize != 0 {
+		if err = checkDiskSize(d.PrimaryDiskSize); err != nil {
+			return err
+		}
+	}
+	d.MountDockerDisk = flags.Bool("skytap-mount-docker-disk")
+	if d.MountDockerDisk && len(d.DiskSizes) == 0 {
+		return errors.New("Mounting a disk at /var/lib/docker requires adding one with --skytap-vm-disk-size")
+	}
+
 	if hasHardware {
-		if hc.CpusPerSocket != nil {
-			if hc.Cpus != nil && *hc.CpusPerSocket != defaultCPUsPerSocket && *hc.Cpus%*hc.CpusPerSocket != 0 {
-				return fmt.Errorf("Specified CPUs (%d) must be a multiple of CPUs per socket (%d)", *hc.Cpus, *hc.CpusPerSocket)
-			} else if hc.Cpus == nil {
-				return fmt.Errorf("Specified CPUs per socket but not CPUs, you must specify CPUs in VM when using this option.")
-			}
+		if err := validateHardware(hc); err != nil {
+			return err
 		}
 		d.HardwareConfig = &hc
 	}
@@ -686,39 +1502,120 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	return nil
 }
 
+func validateHardware(hc api.Hardware) error {
+	if hc.CpusPerSocket != nil {
+		if hc.Cpus != nil && *hc.CpusPerSocket != defaultCPUsPerSocket && *hc.Cpus%*hc.CpusPerSocket != 0 {
+			return fmt.Errorf("Specified CPUs (%d) must be a multiple of CPUs per socket (%d)", *hc.Cpus, *hc.CpusPerSocket)
+		} else if hc.Cpus == nil {
+			return fmt.Errorf("Specified CPUs per socket but not CPUs, you must specify CPUs in VM when using this option.")
+		}
+	}
+	return nil
+}
+
 func validateDeviceConfig(deviceConfig deviceConfig) error {
-	if deviceConfig.SourceVMId == "" {
-		return errors.New("No source VPN specified")
+	sources := 0
+	for _, source := range []string{deviceConfig.SourceVMId, deviceConfig.TemplateId, deviceConfig.TemplateName} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return errors.New("Specify exactly one of a source VM ID, a template ID or a template name")
+	}
+	if deviceConfig.TemplateVMName != "" && deviceConfig.SourceVMId != "" {
+		return errors.New("A template VM name requires a template")
+	}
+	if deviceConfig.EnvironmentName != "" && deviceConfig.EnvironmentId != defaultEnvironmentId {
+		return errors.New("Specify either an environment ID or an environment name, not both")
+	}
+	newEnvironment := deviceConfig.NewEnvironmentName != "" || deviceConfig.EnvironmentDescription != "" || deviceConfig.ProjectId != ""
+	if newEnvironment && (deviceConfig.EnvironmentId != defaultEnvironmentId || deviceConfig.EnvironmentName != "") {
+		return errors.New("The new environment name, description and project only apply when no environment is selected")
+	}
+	if deviceConfig.VPNName != "" && deviceConfig.VPNId != defaultVPNId {
+		return errors.New("Specify either a VPN ID or a VPN name, not both")
+	}
+	if deviceConfig.NetworkId != "" && deviceConfig.NetworkName != "" {
+		return errors.New("Specify either a network ID or a network name, not both")
+	}
+	if deviceConfig.NetworkId != "" && deviceConfig.EnvironmentId == defaultEnvironmentId && deviceConfig.EnvironmentName == "" {
+		return errors.New("A network ID only applies to an existing environment, as Skytap gives the networks of a new environment new IDs; use a network name instead")
+	}
+	if deviceConfig.InterfaceIndex < 0 {
+		return errors.New("Interface index must not be negative")
+	}
+	if (deviceConfig.VPNId != "" || deviceConfig.VPNName != "") && deviceConfig.ICNRTargetNetworkId != "" {
+		return errors.New("Specify either a VPN or an ICNR target network, not both")
 	}
 	return nil
 }
 
 func (d *Driver) Start() error {
 	d.SetLogLevel()
-	client := *api.NewSkytapClientFromCredentials(d.ClientCredentials)
+	client := d.client()
 
 	d.LastState = state.Starting
-	_, err := d.Vm.Start(client)
+	vm, err := api.GetVirtualMachine(client, d.Vm.Id)
+	if err != nil {
+		d.LastState = state.Error
+		return err
+	}
+	d.LastAction = actionStart
+	if vm.Runstate == api.RunStateStart {
+		log.Infof("VM %s is already running", d.Vm.Id)
+	} else {
+		if vm.Runstate == api.RunStatePause {
+			log.Infof("Resuming suspended VM %s", d.Vm.Id)
+		}
+		if _, err = d.Vm.Start(client); err != nil {
+			d.LastState = state.Error
+			return err
+		}
+	}
+
+	ctx := context.Background()
+	err = runPhase(ctx, phaseStart, d.phaseTimeout(), func(ctx context.Context) error {
+		vm, err := waitForRunstate(ctx, client, d.Vm.Id, api.RunStateStart)
+		if err != nil {
+			return err
+		}
+		d.Vm = *vm
+		return nil
+	})
 	if err != nil {
 		d.LastState = state.Error
 		return err
 	}
 	d.LastState = state.Running
 
-	return nil
+	// The VPN NAT address may have changed while the VM was stopped.
+	if err := d.refreshIpAddress(); err != nil {
+		return err
+	}
+	return runPhase(ctx, phaseDocker, d.sshTimeout(), d.waitForDocker)
 }
 
 func (d *Driver) Stop() error {
+	return d.stop(d.StopMode)
+}
+
+func (d *Driver) stop(mode string) error {
 	d.SetLogLevel()
-	client := *api.NewSkytapClientFromCredentials(d.ClientCredentials)
+	client := d.client()
 	d.LastState = state.Stopping
-	_, err := d.Vm.Stop(client)
+	var err error
+	if mode == stopModeSuspend {
+		err = d.suspend(client)
+	} else {
+		err = d.shutdown(client)
+	}
 	if err != nil {
 		d.LastState = state.Error
 		return err
 	}
 	d.LastState = state.Stopped
-	return err
+	return nil
 }
 
 func (d *Driver) SetLogLevel() {
@@ -0,0 +1,1012 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/mcnflag"
+	"github.com/docker/machine/libmachine/state"
+	"github.com/skytap/docker-machine-driver-skytap/docker/driver/skytaptest"
+	"github.com/skytap/skytap-sdk-go/api"
+)
+
+const (
+	testMachineName = "machine"
+	testPublicIp    = "203.0.113.10"
+)
+
+func TestMain(m *testing.M) {
+	// The fake API has no VMs to connect to, and answers straight away.
+	pollInterval = time.Millisecond
+	sshRetryInterval = time.Millisecond
+	installSshKey = func(d *Driver, ctx context.Context) error { return nil }
+	probeMachine = func(d *Driver) error { return nil }
+	runSSHCommand = func(d drivers.Driver, command string) (string, error) { return "", nil }
+	os.Exit(m.Run())
+}
+
+// testFlags are driver options holding the defaults of the driver's create
+// flags, as docker-machine passes them.
+type testFlags map[string]interface{}
+
+func newTestFlags(d *Driver, values map[string]interface{}) testFlags {
+	flags := testFlags{}
+	for _, flag := range d.GetCreateFlags() {
+		switch f := flag.(type) {
+		case mcnflag.StringFlag:
+			flags[f.Name] = f.Value
+		case mcnflag.IntFlag:
+			flags[f.Name] = f.Value
+		case mcnflag.StringSliceFlag:
+			flags[f.Name] = f.Value
+		case mcnflag.BoolFlag:
+			flags[f.Name] = false
+		}
+	}
+	for name, value := range values {
+		flags[name] = value
+	}
+	return flags
+}
+
+func (f testFlags) String(key string) string        { v, _ := f[key].(string); return v }
+func (f testFlags) StringSlice(key string) []string { v, _ := f[key].([]string); return v }
+func (f testFlags) Int(key string) int              { v, _ := f[key].(int); return v }
+func (f testFlags) Bool(key string) bool            { v, _ := f[key].(bool); return v }
+
+// testEnv is a fake Skytap API along with a machine store to create machines
+// in.
+type testEnv struct {
+	t         *testing.T
+	server    *skytaptest.Server
+	storePath string
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	storePath, err := ioutil.TempDir("", "skytap-driver-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testEnv{t, skytaptest.NewServer(), storePath}
+}
+
+func (e *testEnv) close() {
+	e.server.Close()
+	os.RemoveAll(e.storePath)
+}
+
+// driver configures a driver for the fake API from the given flags.
+func (e *testEnv) driver(flags map[string]interface{}) *Driver {
+	e.t.Helper()
+	d, err := e.configure(flags)
+	if err != nil {
+		e.t.Fatalf("SetConfigFromFlags: %s", err)
+	}
+	return d
+}
+
+func (e *testEnv) configure(flags map[string]interface{}) (*Driver, error) {
+	d := NewDriver(testMachineName, e.storePath).(*Driver)
+	if err := os.MkdirAll(d.ResolveStorePath("."), 0700); err != nil {
+		e.t.Fatal(err)
+	}
+	err := d.SetConfigFromFlags(newTestFlags(d, flags))
+	d.HTTPClient = e.server.Client()
+	d.RetryPolicy = ExponentialBackoff{MaxRetries: 3, Base: time.Millisecond, Max: 10 * time.Millisecond}
+	return d, err
+}
+
+// create creates a machine from the given flags, failing the test if that
+// does not work.
+func (e *testEnv) create(flags map[string]interface{}) *Driver {
+	e.t.Helper()
+	d := e.driver(flags)
+	if err := d.PreCreateCheck(); err != nil {
+		e.t.Fatalf("PreCreateCheck: %s", err)
+	}
+	if err := d.Create(); err != nil {
+		e.t.Fatalf("Create: %s", err)
+	}
+	return d
+}
+
+// templateFlags selects a new one-VM template as the source of a machine
+// reached through a public IP.
+func (e *testEnv) templateFlags() map[string]interface{} {
+	e.server.AddPublicIp(testPublicIp)
+	template, _ := e.server.AddTemplate("golden", "docker")
+	return map[string]interface{}{
+		"skytap-template-id": template.Id,
+		"skytap-public-ip":   publicIpAuto,
+	}
+}
+
+func (e *testEnv) vm(id string) *skytaptest.VM {
+	e.server.Lock()
+	defer e.server.Unlock()
+	return e.server.VMs[id]
+}
+
+func (e *testEnv) environment(id string) *skytaptest.Environment {
+	e.server.Lock()
+	defer e.server.Unlock()
+	return e.server.Environments[id]
+}
+
+func (e *testEnv) setRunstate(vmId string, runstates ...string) {
+	e.server.Lock()
+	defer e.server.Unlock()
+	vm := e.server.VMs[vmId]
+	vm.Runstate = runstates[len(runstates)-1]
+	vm.Runstates = runstates[:len(runstates)-1]
+}
+
+func checkError(t *testing.T, err error, wantErr string) {
+	t.Helper()
+	switch {
+	case wantErr == "" && err != nil:
+		t.Errorf("unexpected error: %s", err)
+	case wantErr != "" && err == nil:
+		t.Errorf("expected an error containing %q", wantErr)
+	case wantErr != "" && !strings.Contains(err.Error(), wantErr):
+		t.Errorf("error %q does not contain %q", err, wantErr)
+	}
+}
+
+func TestPreCreateCheck(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(e *testEnv) map[string]interface{}
+		// wantErr is part of the expected error message; "" means success
+		// and "?" any error.
+		wantErr string
+	}{
+		{
+			name:  "template reached through public IP",
+			setup: (*testEnv).templateFlags,
+		},
+		{
+			name: "source VM reached through VPN",
+			setup: func(e *testEnv) map[string]interface{} {
+				_, vms := e.server.AddEnvironment("source", "docker")
+				vpn := e.server.AddVpn("office")
+				return map[string]interface{}{"skytap-vm-id": vms[0].Id, "skytap-vpn-id": vpn.Id}
+			},
+		},
+		{
+			name: "template and VPN by name",
+			setup: func(e *testEnv) map[string]interface{} {
+				e.server.AddTemplate("golden", "docker")
+				e.server.AddVpn("office")
+				return map[string]interface{}{"skytap-template-name": "golden", "skytap-vpn-name": "office"}
+			},
+		},
+		{
+			name: "missing source VM",
+			setup: func(e *testEnv) map[string]interface{} {
+				e.server.AddPublicIp(testPublicIp)
+				return map[string]interface{}{"skytap-vm-id": "404", "skytap-public-ip": publicIpAuto}
+			},
+			wantErr: "?",
+		},
+		{
+			name: "template with several VMs",
+			setup: func(e *testEnv) map[string]interface{} {
+				template, _ := e.server.AddTemplate("golden", "docker", "db")
+				return map[string]interface{}{"skytap-template-id": template.Id, "skytap-public-ip": publicIpServices}
+			},
+			wantErr: "has 2 VMs",
+		},
+		{
+			name: "no way to reach the machine",
+			setup: func(e *testEnv) map[string]interface{} {
+				template, _ := e.server.AddTemplate("golden", "docker")
+				return map[string]interface{}{"skytap-template-id": template.Id}
+			},
+			wantErr: "a VPN, ICNR target network or public IP is required",
+		},
+		{
+			name: "missing VPN",
+			setup: func(e *testEnv) map[string]interface{} {
+				template, _ := e.server.AddTemplate("golden", "docker")
+				return map[string]interface{}{"skytap-template-id": template.Id, "skytap-vpn-id": "404"}
+			},
+			wantErr: "?",
+		},
+		{
+			name: "no public IP available",
+			setup: func(e *testEnv) map[string]interface{} {
+				template, _ := e.server.AddTemplate("golden", "docker")
+				return map[string]interface{}{"skytap-template-id": template.Id, "skytap-public-ip": publicIpAuto}
+			},
+			wantErr: "No unattached public IP",
+		},
+		{
+			name: "missing project",
+			setup: func(e *testEnv) map[string]interface{} {
+				flags := e.templateFlags()
+				flags["skytap-project-id"] = "404"
+				return flags
+			},
+			wantErr: "?",
+		},
+		{
+			name: "missing environment name",
+			setup: func(e *testEnv) map[string]interface{} {
+				flags := e.templateFlags()
+				flags["skytap-env-name"] = "shared"
+				return flags
+			},
+			wantErr: "No environment named 'shared'",
+		},
+		{
+			name: "hostname taken in environment",
+			setup: func(e *testEnv) map[string]interface{} {
+				env, _ := e.server.AddEnvironment("shared", testMachineName)
+				flags := e.templateFlags()
+				flags["skytap-env-id"] = env.Id
+				return flags
+			},
+			wantErr: "already exists in this environment",
+		},
+		{
+			name: "missing interface",
+			setup: func(e *testEnv) map[string]interface{} {
+				flags := e.templateFlags()
+				flags["skytap-interface-index"] = 1
+				return flags
+			},
+			wantErr: "Interface index 1 requested",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			d := e.driver(test.setup(e))
+			err := d.PreCreateCheck()
+			if test.wantErr == "?" {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			checkError(t, err, test.wantErr)
+		})
+	}
+}
+
+func TestCreateNewEnvironment(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(e *testEnv) map[string]interface{}
+	}{
+		{
+			name:  "from template",
+			setup: (*testEnv).templateFlags,
+		},
+		{
+			name: "from template VM by name",
+			setup: func(e *testEnv) map[string]interface{} {
+				e.server.AddPublicIp(testPublicIp)
+				e.server.AddTemplate("golden", "docker", "db")
+				return map[string]interface{}{
+					"skytap-template-name":    "golden",
+					"skytap-template-vm-name": "docker",
+					"skytap-public-ip":        publicIpAuto,
+				}
+			},
+		},
+		{
+			name: "by copying the source VM's environment",
+			setup: func(e *testEnv) map[string]interface{} {
+				e.server.AddPublicIp(testPublicIp)
+				_, vms := e.server.AddEnvironment("source", "docker", "db")
+				return map[string]interface{}{"skytap-vm-id": vms[0].Id, "skytap-public-ip": publicIpAuto}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			d := e.create(test.setup(e))
+
+			if !d.OwnsEnvironment {
+				t.Error("driver does not own the environment it created")
+			}
+			env := e.environment(d.DeviceConfig.EnvironmentId)
+			if env == nil {
+				t.Fatalf("environment %s not found", d.DeviceConfig.EnvironmentId)
+			}
+			if len(env.VmIds) != 1 || env.VmIds[0] != d.Vm.Id {
+				t.Errorf("environment VMs %v, want only %s", env.VmIds, d.Vm.Id)
+			}
+			if env.Name != "docker-machine-"+testMachineName {
+				t.Errorf("environment named %q", env.Name)
+			}
+			vm := e.vm(d.Vm.Id)
+			if vm.Name != testMachineName || vm.Interfaces[0].Hostname != testMachineName {
+				t.Errorf("VM named %q with hostname %q, want %q", vm.Name, vm.Interfaces[0].Hostname, testMachineName)
+			}
+			if vm.Runstate != skytaptest.RunStateRunning {
+				t.Errorf("VM is %s, want running", vm.Runstate)
+			}
+			if d.IPAddress != testPublicIp {
+				t.Errorf("IP address %q, want %q", d.IPAddress, testPublicIp)
+			}
+		})
+	}
+}
+
+func TestCreateInExistingEnvironment(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(e *testEnv) map[string]interface{}
+	}{
+		{
+			name:  "from template",
+			setup: (*testEnv).templateFlags,
+		},
+		{
+			name: "from a VM in another environment",
+			setup: func(e *testEnv) map[string]interface{} {
+				e.server.AddPublicIp(testPublicIp)
+				_, vms := e.server.AddEnvironment("source", "docker")
+				return map[string]interface{}{"skytap-vm-id": vms[0].Id, "skytap-public-ip": publicIpAuto}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			shared, others := e.server.AddEnvironment("shared", "other")
+			flags := test.setup(e)
+			flags["skytap-env-id"] = shared.Id
+			d := e.create(flags)
+
+			if d.OwnsEnvironment {
+				t.Error("driver owns an environment it did not create")
+			}
+			if d.DeviceConfig.EnvironmentId != shared.Id {
+				t.Errorf("machine in environment %s, want %s", d.DeviceConfig.EnvironmentId, shared.Id)
+			}
+			env := e.environment(shared.Id)
+			if len(env.VmIds) != 2 || env.VmIds[0] != others[0].Id || env.VmIds[1] != d.Vm.Id {
+				t.Errorf("environment VMs %v, want %s and %s", env.VmIds, others[0].Id, d.Vm.Id)
+			}
+			if name := e.vm(d.Vm.Id).Name; name != testMachineName {
+				t.Errorf("VM named %q, want %q", name, testMachineName)
+			}
+			if name := e.vm(others[0].Id).Name; name != "other" {
+				t.Errorf("other VM renamed to %q", name)
+			}
+		})
+	}
+}
+
+func TestCreateDescribesNewEnvironment(t *testing.T) {
+	tests := []struct {
+		name            string
+		flags           map[string]interface{}
+		wantName        string
+		wantDescription string
+		wantProject     bool
+	}{
+		{
+			name:     "defaults",
+			wantName: "docker-machine-" + testMachineName,
+		},
+		{
+			name: "name, description and project",
+			flags: map[string]interface{}{
+				"skytap-new-env-name":    "Docker hosts",
+				"skytap-env-description": "Created by CI",
+			},
+			wantName:        "Docker hosts",
+			wantDescription: "Created by CI",
+			wantProject:     true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			project := e.server.AddProject("docker")
+			flags := e.templateFlags()
+			for name, value := range test.flags {
+				flags[name] = value
+			}
+			if test.wantProject {
+				flags["skytap-project-id"] = project.Id
+			}
+			d := e.create(flags)
+
+			env := e.environment(d.DeviceConfig.EnvironmentId)
+			e.server.Lock()
+			defer e.server.Unlock()
+			if env.Name != test.wantName || env.Description != test.wantDescription {
+				t.Errorf("environment named %q described %q, want %q and %q", env.Name, env.Description, test.wantName, test.wantDescription)
+			}
+			inProject := len(project.EnvironmentIds) == 1 && project.EnvironmentIds[0] == env.Id
+			if inProject != test.wantProject {
+				t.Errorf("environment in project: %t, want %t", inProject, test.wantProject)
+			}
+		})
+	}
+}
+
+func TestCreateInEnvironmentSelectedByName(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	shared, _ := e.server.AddEnvironment("shared", "other")
+	flags := e.templateFlags()
+	flags["skytap-env-name"] = "shared"
+	d := e.create(flags)
+
+	if d.DeviceConfig.EnvironmentId != shared.Id || d.OwnsEnvironment {
+		t.Errorf("machine in environment %s, owned %t, want %s not owned", d.DeviceConfig.EnvironmentId, d.OwnsEnvironment, shared.Id)
+	}
+	if name := e.environment(shared.Id).Name; name != "shared" {
+		t.Errorf("existing environment renamed to %q", name)
+	}
+}
+
+func TestNewEnvironmentOptionsRequireNoEnvironment(t *testing.T) {
+	options := map[string]interface{}{
+		"skytap-new-env-name":    "Docker hosts",
+		"skytap-env-description": "Created by CI",
+		"skytap-project-id":      "1",
+	}
+	for option, value := range options {
+		for _, selection := range []string{"skytap-env-id", "skytap-env-name"} {
+			e := newTestEnv(t)
+			_, err := e.configure(map[string]interface{}{"skytap-template-id": "1", selection: "1", option: value})
+			e.close()
+			checkError(t, err, "only apply when no environment is selected")
+		}
+	}
+}
+
+func TestCreateConnectsVpn(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	template, _ := e.server.AddTemplate("golden", "docker")
+	vpn := e.server.AddVpn("office")
+	d := e.create(map[string]interface{}{"skytap-template-id": template.Id, "skytap-vpn-id": vpn.Id})
+
+	network := e.environment(d.DeviceConfig.EnvironmentId).Networks[0]
+	if len(network.VpnAttachments) != 1 || !network.VpnAttachments[0].Connected {
+		t.Fatalf("VPN attachments %+v, want one connected", network.VpnAttachments)
+	}
+	nat := e.vm(d.Vm.Id).Interfaces[0].NatAddresses.VpnNatAddresses
+	if len(nat) != 1 || d.IPAddress != nat[0].IpAddress {
+		t.Errorf("IP address %q, want the VPN NAT address in %+v", d.IPAddress, nat)
+	}
+}
+
+func TestCreateRollsBackOnFailure(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing bool
+		// fail makes Create fail after the environment or VM was made.
+		fail func(e *testEnv)
+	}{
+		{
+			name: "new environment, naming the VM fails",
+			fail: func(e *testEnv) { e.server.FailNext("PUT", "/vms/", http.StatusUnprocessableEntity, 1) },
+		},
+		{
+			name: "new environment, SSH fails",
+			fail: func(e *testEnv) { installSshKey = failSsh },
+		},
+		{
+			name:     "existing environment, naming the VM fails",
+			existing: true,
+			fail:     func(e *testEnv) { e.server.FailNext("PUT", "/vms/", http.StatusUnprocessableEntity, 1) },
+		},
+		{
+			name:     "existing environment, SSH fails",
+			existing: true,
+			fail:     func(e *testEnv) { installSshKey = failSsh },
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			defer restoreSsh(installSshKey)
+			shared, others := e.server.AddEnvironment("shared", "other")
+			flags := e.templateFlags()
+			if test.existing {
+				flags["skytap-env-id"] = shared.Id
+			}
+			d := e.driver(flags)
+			test.fail(e)
+
+			if err := d.Create(); err == nil {
+				t.Fatal("Create succeeded")
+			}
+
+			e.server.Lock()
+			defer e.server.Unlock()
+			if len(e.server.Environments) != 1 {
+				t.Errorf("%d environments left, want only the shared one", len(e.server.Environments))
+			}
+			if env := e.server.Environments[shared.Id]; len(env.VmIds) != 1 || env.VmIds[0] != others[0].Id {
+				t.Errorf("shared environment VMs %v, want only %s", env.VmIds, others[0].Id)
+			}
+			if ip := e.server.PublicIps[testPublicIp]; len(ip.Nics) != 0 {
+				t.Errorf("public IP still attached to %v", ip.Nics)
+			}
+			if d.OwnsEnvironment || d.DeviceConfig.EnvironmentId != map[bool]string{false: defaultEnvironmentId, true: shared.Id}[test.existing] {
+				t.Errorf("driver left with environment %s, owned %t", d.DeviceConfig.EnvironmentId, d.OwnsEnvironment)
+			}
+		})
+	}
+}
+
+func TestCreateKeepsResourcesOnFailureWhenAsked(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	defer restoreSsh(installSshKey)
+	flags := e.templateFlags()
+	flags["skytap-keep-on-failure"] = true
+	d := e.driver(flags)
+	installSshKey = failSsh
+
+	if err := d.Create(); err == nil {
+		t.Fatal("Create succeeded")
+	}
+	if e.environment(d.DeviceConfig.EnvironmentId) == nil {
+		t.Error("environment was removed")
+	}
+}
+
+func TestCreateRetriesLockedEnvironment(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	shared, _ := e.server.AddEnvironment("shared", "other")
+	flags := e.templateFlags()
+	flags["skytap-env-id"] = shared.Id
+	e.server.FailNext("PUT", "/configurations/"+shared.Id, http.StatusLocked, 2)
+
+	d := e.create(flags)
+
+	if env := e.environment(shared.Id); len(env.VmIds) != 2 {
+		t.Errorf("environment VMs %v, want 2", env.VmIds)
+	}
+	if d.Vm.Id == "" {
+		t.Error("no VM recorded")
+	}
+}
+
+func TestCreateRetriesNicRename(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	shared, _ := e.server.AddEnvironment("shared", "other")
+	flags := e.templateFlags()
+	flags["skytap-env-id"] = shared.Id
+	e.server.FailNext("PUT", "/configurations/"+shared.Id+"/vms/", http.StatusBadRequest, 1)
+
+	d := e.create(flags)
+
+	if nic := e.vm(d.Vm.Id).Interfaces[0]; nic.Hostname != testMachineName {
+		t.Errorf("NIC named %q, want %q", nic.Hostname, testMachineName)
+	}
+}
+
+func TestCreateNamesExpiredPhase(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	shared, vms := e.server.AddEnvironment("shared", "other")
+	e.setRunstate(vms[0].Id, skytaptest.RunStateBusy)
+	flags := e.templateFlags()
+	flags["skytap-env-id"] = shared.Id
+	flags["skytap-phase-timeout"] = 1
+
+	d := e.driver(flags)
+	if err := d.PreCreateCheck(); err != nil {
+		t.Fatalf("PreCreateCheck: %s", err)
+	}
+	err := d.Create()
+
+	checkError(t, err, "Timed out waiting for environment ready (phase limit 1s")
+}
+
+// concurrentAdd adds a VM to an environment just before the driver does, as
+// a machine created from another store would.
+type concurrentAdd struct {
+	next  http.RoundTripper
+	path  string
+	added func()
+}
+
+func (t *concurrentAdd) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == "PUT" && req.URL.Path == t.path && t.added != nil {
+		t.added()
+		t.added = nil
+	}
+	return t.next.RoundTrip(req)
+}
+
+func TestCreateLeavesAmbiguousAdd(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	shared, _ := e.server.AddEnvironment("shared", "other")
+	flags := e.templateFlags()
+	flags["skytap-env-id"] = shared.Id
+	d := e.driver(flags)
+	var other *skytaptest.VM
+	d.HTTPClient.Transport = &concurrentAdd{
+		next: d.HTTPClient.Transport,
+		path: "/configurations/" + shared.Id,
+		added: func() {
+			other = e.server.AddVM(shared.Id, "docker")
+		},
+	}
+
+	err := d.Create()
+	checkError(t, err, "Unable to identify the VM added")
+	checkError(t, err, other.Id)
+
+	// Either new VM may be the other machine's, so both are left.
+	if env := e.environment(shared.Id); len(env.VmIds) != 3 {
+		t.Errorf("%d VMs left in the environment, want 3", len(env.VmIds))
+	}
+	if e.vm(other.Id) == nil {
+		t.Error("other machine's VM was deleted")
+	}
+}
+
+// allTemplateVms drops the VM selection from requests creating environments,
+// so that Skytap copies every VM of the template.
+type allTemplateVms struct {
+	next http.RoundTripper
+}
+
+func (t *allTemplateVms) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == "POST" && req.URL.Path == "/configurations" {
+		body := map[string]interface{}{}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return nil, err
+		}
+		delete(body, "vm_ids")
+		data, _ := json.Marshal(body)
+		req.Body = ioutil.NopCloser(bytes.NewReader(data))
+		req.ContentLength = int64(len(data))
+	}
+	return t.next.RoundTrip(req)
+}
+
+func TestCreateRollsBackEnvironmentWithUnexpectedVms(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	e.server.AddPublicIp(testPublicIp)
+	template, _ := e.server.AddTemplate("golden", "docker", "db")
+	d := e.driver(map[string]interface{}{
+		"skytap-template-id":      template.Id,
+		"skytap-template-vm-name": "docker",
+		"skytap-public-ip":        publicIpAuto,
+	})
+	d.HTTPClient.Transport = &allTemplateVms{d.HTTPClient.Transport}
+
+	err := d.Create()
+	checkError(t, err, "to contain one VM, found 2")
+
+	e.server.Lock()
+	defer e.server.Unlock()
+	if len(e.server.Environments) != 0 {
+		t.Errorf("%d environments left, want none", len(e.server.Environments))
+	}
+	if d.OwnsEnvironment || d.DeviceConfig.EnvironmentId != defaultEnvironmentId {
+		t.Errorf("driver left with environment %s, owned %t", d.DeviceConfig.EnvironmentId, d.OwnsEnvironment)
+	}
+}
+
+func TestAddedVmIds(t *testing.T) {
+	env := &api.Environment{Id: "1", Vms: []*api.VirtualMachine{{Id: "10"}, {Id: "11"}, {Id: "12"}}}
+	tests := []struct {
+		existing map[string]bool
+		want     []string
+	}{
+		{map[string]bool{"10": true, "11": true}, []string{"12"}},
+		{map[string]bool{"10": true}, []string{"11", "12"}},
+		{map[string]bool{"10": true, "11": true, "12": true}, nil},
+	}
+	for _, test := range tests {
+		if got := addedVmIds(test.existing, env); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("added to %v: %v, want %v", test.existing, got, test.want)
+		}
+	}
+}
+
+func failSsh(d *Driver, ctx context.Context) error {
+	return errors.New("connection refused")
+}
+
+func restoreSsh(install func(*Driver, context.Context) error) {
+	installSshKey = install
+}
+
+func TestGetState(t *testing.T) {
+	tests := []struct {
+		runstates  []string
+		lastAction string
+		stopMode   string
+		want       state.State
+	}{
+		{[]string{skytaptest.RunStateRunning}, "", "", state.Running},
+		{[]string{skytaptest.RunStateStopped}, "", "", state.Stopped},
+		{[]string{skytaptest.RunStateHalted}, "", "", state.Stopped},
+		{[]string{skytaptest.RunStateSuspended}, "", "", state.Paused},
+		{[]string{skytaptest.RunStateSuspended}, actionStop, stopModeShutdown, state.Paused},
+		{[]string{skytaptest.RunStateSuspended}, actionStart, stopModeSuspend, state.Paused},
+		{[]string{skytaptest.RunStateSuspended}, actionStop, stopModeSuspend, state.Stopped},
+		{[]string{runStateReset}, "", "", state.Starting},
+		{[]string{skytaptest.RunStateBusy, skytaptest.RunStateRunning}, actionStart, "", state.Starting},
+		{[]string{skytaptest.RunStateBusy, skytaptest.RunStateStopped}, actionStop, "", state.Stopping},
+		{[]string{skytaptest.RunStateBusy, skytaptest.RunStateRunning}, "", "", state.Starting},
+		{[]string{"unheard-of"}, "", "", state.Error},
+	}
+
+	for _, test := range tests {
+		name := strings.Join(test.runstates, ",") + "/" + test.lastAction + "/" + test.stopMode
+		t.Run(name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			_, vms := e.server.AddEnvironment("env", "docker")
+			e.setRunstate(vms[0].Id, test.runstates...)
+			d := e.driver(map[string]interface{}{"skytap-vm-id": vms[0].Id, "skytap-stop-mode": test.stopMode})
+			d.Vm.Id = vms[0].Id
+			d.LastAction = test.lastAction
+
+			got, err := d.GetState()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want || d.LastState != test.want {
+				t.Errorf("state %s (recorded %s), want %s", got, d.LastState, test.want)
+			}
+		})
+	}
+}
+
+func TestPowerOperations(t *testing.T) {
+	tests := []struct {
+		name     string
+		operate  func(d *Driver) error
+		runstate string
+		want     state.State
+	}{
+		{"stop", (*Driver).Stop, skytaptest.RunStateStopped, state.Stopped},
+		// Kill does not wait for the VM to stop.
+		{"kill", (*Driver).Kill, skytaptest.RunStateStopped, state.Stopping},
+		{"restart", (*Driver).Restart, skytaptest.RunStateRunning, state.Running},
+		{"stop and start", func(d *Driver) error {
+			if err := d.Stop(); err != nil {
+				return err
+			}
+			return d.Start()
+		}, skytaptest.RunStateRunning, state.Running},
+		{"start running VM", (*Driver).Start, skytaptest.RunStateRunning, state.Running},
+		{"suspend", func(d *Driver) error {
+			d.StopMode = stopModeSuspend
+			return d.Stop()
+		}, skytaptest.RunStateSuspended, state.Stopped},
+		{"suspend and resume", func(d *Driver) error {
+			d.StopMode = stopModeSuspend
+			if err := d.Stop(); err != nil {
+				return err
+			}
+			return d.Start()
+		}, skytaptest.RunStateRunning, state.Running},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			d := e.create(e.templateFlags())
+			e.server.TransitionPolls = 2
+
+			if err := test.operate(d); err != nil {
+				t.Fatal(err)
+			}
+			if runstate := e.vm(d.Vm.Id).Runstate; runstate != test.runstate {
+				t.Errorf("VM is %s, want %s", runstate, test.runstate)
+			}
+			got, err := d.GetState()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("state %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestStopRetriesBusyVm(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	d := e.create(e.templateFlags())
+	e.server.FailNext("PUT", "/vms/"+d.Vm.Id, http.StatusConflict, 2)
+
+	if err := d.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if runstate := e.vm(d.Vm.Id).Runstate; runstate != skytaptest.RunStateStopped {
+		t.Errorf("VM is %s, want stopped", runstate)
+	}
+}
+
+func TestStartLeavesRunningVmAlone(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	d := e.create(e.templateFlags())
+	before := len(e.server.Requests())
+
+	if err := d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, request := range e.server.Requests()[before:] {
+		if strings.HasPrefix(request, "PUT /vms/") {
+			t.Errorf("running VM was changed with %s", request)
+		}
+	}
+}
+
+func TestStartFailsWhenVmCannotStart(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	d := e.create(e.templateFlags())
+	if err := d.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	e.server.FailNext("PUT", "/vms/"+d.Vm.Id, http.StatusUnprocessableEntity, 1)
+
+	if err := d.Start(); err == nil {
+		t.Fatal("Start succeeded")
+	}
+	if d.LastState != state.Error {
+		t.Errorf("recorded state %s, want Error", d.LastState)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing bool
+		// others is the number of other machines created into the same
+		// environment afterwards.
+		others          int
+		wantEnvironment bool
+	}{
+		{name: "last VM of own environment", wantEnvironment: false},
+		{name: "own environment with other VMs", others: 1, wantEnvironment: true},
+		{name: "existing environment", existing: true, wantEnvironment: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			shared, _ := e.server.AddEnvironment("shared", "other")
+			flags := e.templateFlags()
+			if test.existing {
+				flags["skytap-env-id"] = shared.Id
+			}
+			d := e.create(flags)
+			envId := d.DeviceConfig.EnvironmentId
+			for i := 0; i < test.others; i++ {
+				e.server.AddVM(envId, "other")
+			}
+
+			if err := d.Remove(); err != nil {
+				t.Fatal(err)
+			}
+
+			if e.vm(d.Vm.Id) != nil {
+				t.Error("VM was not deleted")
+			}
+			if got := e.environment(envId) != nil; got != test.wantEnvironment {
+				t.Errorf("environment exists: %t, want %t", got, test.wantEnvironment)
+			}
+			e.server.Lock()
+			defer e.server.Unlock()
+			if ip := e.server.PublicIps[testPublicIp]; len(ip.Nics) != 0 {
+				t.Errorf("public IP still attached to %v", ip.Nics)
+			}
+		})
+	}
+}
+
+func TestRemoveHalfDeletedMachine(t *testing.T) {
+	tests := []struct {
+		name string
+		// deleteFirst deletes part of the machine before it is removed.
+		deleteFirst func(d *Driver, client api.SkytapClient) error
+	}{
+		{"VM deleted", func(d *Driver, client api.SkytapClient) error {
+			return deleteVm(client, d.Vm.Id)
+		}},
+		{"environment deleted", func(d *Driver, client api.SkytapClient) error {
+			return deleteEnvironment(client, d.DeviceConfig.EnvironmentId)
+		}},
+		{"public IP released", func(d *Driver, client api.SkytapClient) error {
+			return detachPublicIp(client, d.DeviceConfig.EnvironmentId, d.Vm.Id, d.Vm.Interfaces[0].Id, d.PublicIp)
+		}},
+		{"ICNR tunnel deleted", func(d *Driver, client api.SkytapClient) error {
+			return deleteTunnel(client, d.ICNRTunnelId)
+		}},
+		{"removed before", func(d *Driver, client api.SkytapClient) error {
+			saved := *d
+			return saved.Remove()
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			target, _ := e.server.AddEnvironment("office")
+			flags := e.templateFlags()
+			flags["skytap-icnr-target-network"] = target.Networks[0].Id
+			d := e.create(flags)
+			envId := d.DeviceConfig.EnvironmentId
+			if err := test.deleteFirst(d, d.client()); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := d.Remove(); err != nil {
+				t.Fatal(err)
+			}
+
+			if e.vm(d.Vm.Id) != nil {
+				t.Error("VM was not deleted")
+			}
+			if e.environment(envId) != nil {
+				t.Error("environment was not deleted")
+			}
+			e.server.Lock()
+			defer e.server.Unlock()
+			if len(e.server.Tunnels) != 0 {
+				t.Errorf("tunnels %v were not deleted", e.server.Tunnels)
+			}
+			if ip := e.server.PublicIps[testPublicIp]; len(ip.Nics) != 0 {
+				t.Errorf("public IP still attached to %v", ip.Nics)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/skytap/skytap-sdk-go/api"
+)
+
+// minRam is the least RAM, in megabytes, Skytap gives a VM.
+const minRam = 256
+
+// Skytap quotas checked before creating a machine.
+const (
+	quotaConcurrentVms     = "concurrent_vms"
+	quotaConcurrentStorage = "concurrent_storage_size"
+)
+
+// hardwareLimits is the hardware of a VM along with the limits Skytap sets
+// for changing it.
+type hardwareLimits struct {
+	Cpus              int    `json:"cpus"`
+	CpusPerSocket     int    `json:"cpus_per_socket"`
+	Ram               int    `json:"ram"`
+	MaxCpus           int    `json:"max_cpus"`
+	MaxRam            int    `json:"max_ram"`
+	SupportsMulticore bool   `json:"supports_multicore"`
+	Disks             []disk `json:"disks"`
+}
+
+type quota struct {
+	Id    string   `json:"id"`
+	Usage float64  `json:"usage"`
+	Limit *float64 `json:"limit"`
+	Units string   `json:"units"`
+}
+
+func getHardware(client api.SkytapClient, source *machineSource) (*hardwareLimits, error) {
+	path := fmt.Sprintf("/vms/%s", source.vm.Id)
+	if source.templateId != "" {
+		path = fmt.Sprintf("/templates/%s/vms/%s", source.templateId, source.vm.Id)
+	}
+	var vm struct {
+		Hardware hardwareLimits `json:"hardware"`
+	}
+	if err := skytapRequest(client, "GET", path, nil, &vm); err != nil {
+		return nil, err
+	}
+	return &vm.Hardware, nil
+}
+
+// checkHardwareConfig verifies the requested CPUs and RAM are possible for a
+// VM with the given hardware.
+func checkHardwareConfig(hc api.Hardware, hardware *hardwareLimits) error {
+	if hc.Cpus != nil && (*hc.Cpus < 1 || (hardware.MaxCpus > 0 && *hc.Cpus > hardware.MaxCpus)) {
+		return fmt.Errorf("Requested %d CPUs but the VM allows %s", *hc.Cpus, allowedRange(1, hardware.MaxCpus, ""))
+	}
+	if hc.CpusPerSocket != nil && *hc.CpusPerSocket > 1 && !hardware.SupportsMulticore {
+		return fmt.Errorf("Requested %d CPUs per socket but the VM's operating system does not support multicore CPUs", *hc.CpusPerSocket)
+	}
+	if hc.Ram != nil && (*hc.Ram < minRam || (hardware.MaxRam > 0 && *hc.Ram > hardware.MaxRam)) {
+		return fmt.Errorf("Requested %d MB of RAM but the VM allows %s", *hc.Ram, allowedRange(minRam, hardware.MaxRam, " MB"))
+	}
+	return nil
+}
+
+// allowedRange describes the values from min up to max, or from min up if
+// Skytap reported no maximum.
+func allowedRange(min, max int, unit string) string {
+	if max > 0 {
+		return fmt.Sprintf("%d to %d%s", min, max, unit)
+	}
+	return fmt.Sprintf("at least %d%s", min, unit)
+}
+
+// checkHardware verifies the requested CPUs, RAM and disks are possible for a
+// VM with the given hardware.
+func (d *Driver) checkHardware(hardware *hardwareLimits) error {
+	if d.HardwareConfig != nil {
+		if err := checkHardwareConfig(*d.HardwareConfig, hardware); err != nil {
+			return err
+		}
+	}
+
+	if len(hardware.Disks)+len(d.DiskSizes) > maxDisks {
+		return fmt.Errorf("The source VM has %d disks, adding %d would exceed the %d Skytap allows", len(hardware.Disks), len(d.DiskSizes), maxDisks)
+	}
+	if d.PrimaryDiskSize != 0 && len(hardware.Disks) > 0 && d.PrimaryDiskSize < hardware.Disks[0].Size {
+		return fmt.Errorf("The source VM's primary disk is %d MB, it cannot shrink to %d MB", hardware.Disks[0].Size, d.PrimaryDiskSize)
+	}
+	return nil
+}
+
+// checkQuotas verifies the account can run one more VM and store its disks.
+// Users who may not read the account's quotas skip the check.
+func (d *Driver) checkQuotas(client api.SkytapClient, hardware *hardwareLimits) error {
+	var quotas []quota
+	if err := skytapRequest(client, "GET", "/company/quotas", nil, &quotas); err != nil {
+		if apiErr, ok := err.(*apiError); ok && (apiErr.StatusCode == http.StatusForbidden || apiErr.StatusCode == http.StatusNotFound) {
+			log.Infof("Unable to read account quotas, skipping quota check: %s", err)
+			return nil
+		}
+		return err
+	}
+
+	storage := 0
+	for _, disk := range hardware.Disks {
+		storage += disk.Size
+	}
+	if d.PrimaryDiskSize != 0 && len(hardware.Disks) > 0 {
+		storage += d.PrimaryDiskSize - hardware.Disks[0].Size
+	}
+	for _, size := range d.DiskSizes {
+		storage += size
+	}
+
+	for _, q := range quotas {
+		if q.Limit == nil || *q.Limit <= 0 {
+			continue
+		}
+		switch q.Id {
+		case quotaConcurrentVms:
+			if q.Usage+1 > *q.Limit {
+				return fmt.Errorf("Running another VM would exceed the account's quota of %.0f concurrent VMs (%.0f in use)", *q.Limit, q.Usage)
+			}
+		case quotaConcurrentStorage:
+			needed := float64(storage)
+			if q.Units == "GB" {
+				needed /= 1024
+			}
+			if q.Usage+needed > *q.Limit {
+				return fmt.Errorf("The VM's %d MB of disks would exceed the account's storage quota of %.0f %s (%.0f in use)", storage, *q.Limit, q.Units, q.Usage)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/skytap/docker-machine-driver-skytap/docker/driver/skytaptest"
+	"github.com/skytap/skytap-sdk-go/api"
+)
+
+func TestPreCreateCheckHardware(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags map[string]interface{}
+		// setup changes the template VM's hardware and the account's
+		// quotas, with the server locked.
+		setup   func(s *skytaptest.Server, vm *skytaptest.VM)
+		wantErr string
+	}{
+		{
+			name:  "within limits",
+			flags: map[string]interface{}{"skytap-vm-cpus": 4, "skytap-vm-cpuspersocket": 2, "skytap-vm-ram": 8192},
+		},
+		{
+			name:    "too many CPUs",
+			flags:   map[string]interface{}{"skytap-vm-cpus": 16},
+			wantErr: "Requested 16 CPUs but the VM allows 1 to 12",
+		},
+		{
+			name:    "too much RAM",
+			flags:   map[string]interface{}{"skytap-vm-ram": 262144},
+			wantErr: "Requested 262144 MB of RAM but the VM allows 256 to 131072 MB",
+		},
+		{
+			name:  "multicore unsupported",
+			flags: map[string]interface{}{"skytap-vm-cpus": 4, "skytap-vm-cpuspersocket": 2},
+			setup: func(s *skytaptest.Server, vm *skytaptest.VM) {
+				vm.Hardware["supports_multicore"] = false
+			},
+			wantErr: "does not support multicore CPUs",
+		},
+		{
+			name:    "primary disk shrunk",
+			flags:   map[string]interface{}{"skytap-vm-primary-disk-size": skytaptest.PrimaryDiskSize / 2},
+			wantErr: "cannot shrink",
+		},
+		{
+			name: "VM quota used up",
+			setup: func(s *skytaptest.Server, vm *skytaptest.VM) {
+				limit := 10.0
+				s.Quotas = []*skytaptest.Quota{{Id: quotaConcurrentVms, Usage: 10, Limit: &limit, Units: "VMs"}}
+			},
+			wantErr: "quota of 10 concurrent VMs",
+		},
+		{
+			name:  "storage quota exceeded by added disk",
+			flags: map[string]interface{}{"skytap-vm-disk-size": []string{"20480"}},
+			setup: func(s *skytaptest.Server, vm *skytaptest.VM) {
+				limit := 100.0
+				s.Quotas = []*skytaptest.Quota{{Id: quotaConcurrentStorage, Usage: 60, Limit: &limit, Units: "GB"}}
+			},
+			wantErr: "storage quota of 100 GB",
+		},
+		{
+			name: "unlimited quotas",
+			setup: func(s *skytaptest.Server, vm *skytaptest.VM) {
+				s.Quotas = []*skytaptest.Quota{{Id: quotaConcurrentVms, Usage: 500}, {Id: quotaConcurrentStorage, Usage: 1e6, Units: "GB"}}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			e.server.AddPublicIp(testPublicIp)
+			template, vms := e.server.AddTemplate("golden", "docker")
+			flags := map[string]interface{}{"skytap-template-id": template.Id, "skytap-public-ip": publicIpAuto}
+			for name, value := range test.flags {
+				flags[name] = value
+			}
+			if test.setup != nil {
+				e.server.Lock()
+				test.setup(e.server, vms[0])
+				e.server.Unlock()
+			}
+			d := e.driver(flags)
+
+			checkError(t, d.PreCreateCheck(), test.wantErr)
+		})
+	}
+}
+
+func TestCheckHardwareConfigBounds(t *testing.T) {
+	few, many, little := 0, 16, 128
+	tests := []struct {
+		name    string
+		hc      api.Hardware
+		limits  hardwareLimits
+		wantErr string
+	}{
+		{"too few CPUs", api.Hardware{Cpus: &few}, hardwareLimits{MaxCpus: 12}, "Requested 0 CPUs but the VM allows 1 to 12"},
+		{"too few CPUs without maximum", api.Hardware{Cpus: &few}, hardwareLimits{}, "Requested 0 CPUs but the VM allows at least 1"},
+		{"many CPUs without maximum", api.Hardware{Cpus: &many}, hardwareLimits{}, ""},
+		{"too little RAM", api.Hardware{Ram: &little}, hardwareLimits{MaxRam: 131072}, "Requested 128 MB of RAM but the VM allows 256 to 131072 MB"},
+		{"too little RAM without maximum", api.Hardware{Ram: &little}, hardwareLimits{}, "Requested 128 MB of RAM but the VM allows at least 256 MB"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checkError(t, checkHardwareConfig(test.hc, &test.limits), test.wantErr)
+		})
+	}
+}
+
+func TestPreCreateCheckSkipsUnreadableQuotas(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	d := e.driver(e.templateFlags())
+	e.server.AddQuota(quotaConcurrentVms, 10, 10, "VMs")
+	e.server.FailNext("GET", "/company/quotas", http.StatusForbidden, 1)
+
+	if err := d.PreCreateCheck(); err != nil {
+		t.Errorf("PreCreateCheck failed for a user who may not read quotas: %s", err)
+	}
+}
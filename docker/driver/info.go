@@ -0,0 +1,136 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/skytap/skytap-sdk-go/api"
+)
+
+// MachineInfo describes the Skytap resources behind a machine.
+type MachineInfo struct {
+	MachineName     string
+	VmId            string
+	VmName          string
+	Runstate        string
+	EnvironmentId   string
+	EnvironmentName string
+	OwnsEnvironment bool
+	IPAddress       string
+	PublicIp        string
+	ICNRTunnelId    string
+	Cpus            int
+	CpusPerSocket   int
+	Ram             int
+	// DiskSizes are the sizes of the VM's disks in megabytes.
+	DiskSizes []int
+}
+
+// Info reads the current state of the machine's VM and environment from
+// Skytap.
+func (d *Driver) Info() (*MachineInfo, error) {
+	d.SetLogLevel()
+	client := d.client()
+
+	var vm struct {
+		Name     string         `json:"name"`
+		Runstate string         `json:"runstate"`
+		Hardware hardwareLimits `json:"hardware"`
+	}
+	if err := skytapRequest(client, "GET", vmPath(d.DeviceConfig.EnvironmentId, d.Vm.Id), nil, &vm); err != nil {
+		return nil, err
+	}
+	env, err := api.GetEnvironment(client, d.DeviceConfig.EnvironmentId)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &MachineInfo{
+		MachineName:     d.MachineName,
+		VmId:            d.Vm.Id,
+		VmName:          vm.Name,
+		Runstate:        vm.Runstate,
+		EnvironmentId:   env.Id,
+		EnvironmentName: env.Name,
+		OwnsEnvironment: d.OwnsEnvironment,
+		IPAddress:       d.IPAddress,
+		PublicIp:        d.PublicIp,
+		ICNRTunnelId:    d.ICNRTunnelId,
+		Cpus:            vm.Hardware.Cpus,
+		CpusPerSocket:   vm.Hardware.CpusPerSocket,
+		Ram:             vm.Hardware.Ram,
+	}
+	for _, disk := range vm.Hardware.Disks {
+		info.DiskSizes = append(info.DiskSizes, disk.Size)
+	}
+	return info, nil
+}
+
+// CollectGarbage deletes what Create made for the machine once its VM is gone
+// from Skytap, for example after it was deleted in the Skytap UI or a Remove
+// failed part way: the ICNR tunnel and the environment, if they were created
+// for the machine and the environment has no VMs left. It returns a
+// description of each resource deleted.
+func (d *Driver) CollectGarbage() ([]string, error) {
+	d.SetLogLevel()
+	client := d.client()
+
+	err := skytapRequest(client, "GET", fmt.Sprintf("/vms/%s", d.Vm.Id), nil, nil)
+	if err == nil {
+		return nil, fmt.Errorf("VM %s of machine %s still exists, remove the machine with docker-machine rm instead", d.Vm.Id, d.MachineName)
+	}
+	if !isNotFound(err) {
+		return nil, err
+	}
+
+	var removed []string
+	env, err := getEnvironment(client, d.DeviceConfig.EnvironmentId)
+	if err != nil {
+		if !isNotFound(err) {
+			return nil, err
+		}
+		log.Infof("Environment %s no longer exists", d.DeviceConfig.EnvironmentId)
+		env = nil
+	}
+	if env != nil && len(env.Vms) > 0 {
+		log.Infof("Environment %s still contains other VMs, keeping it", env.Id)
+		return removed, nil
+	}
+
+	if d.ICNRTunnelId != "" {
+		if err = deleteTunnel(client, d.ICNRTunnelId); err != nil && !isNotFound(err) {
+			return removed, err
+		}
+		removed = append(removed, "ICNR tunnel "+d.ICNRTunnelId)
+		d.ICNRTunnelId = ""
+	}
+	if env != nil && d.OwnsEnvironment {
+		if err = removeEnvironment(client, env); err != nil {
+			return removed, err
+		}
+		removed = append(removed, "environment "+env.Id)
+		d.OwnsEnvironment = false
+	}
+	return removed, nil
+}
+
+// isNotFound reports whether err is a 404 response to a skytapRequest.
+func isNotFound(err error) bool {
+	apiErr, ok := err.(*apiError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,133 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+const (
+	lockDir = "skytap-locks"
+	// staleLockAge is how long a lock file must have gone without being
+	// refreshed before it is assumed to have been left behind by a process
+	// that died while holding it.
+	staleLockAge      = 15 * time.Minute
+	lockRetryInterval = time.Second
+)
+
+// lockRefreshInterval is how often a held lock file is touched, so that it
+// does not look stale however long the change it guards takes.
+var lockRefreshInterval = time.Minute
+
+// lockEnvironment serializes changes to an environment between the machines
+// managed from this machine store, such as several created in parallel into
+// the same environment. It returns a function that releases the lock.
+//
+// The lock is a file created exclusively in the store, which works on every
+// platform docker-machine runs on. Machines managed from other stores are
+// not covered; Skytap's lock errors are retried for those.
+func (d *Driver) lockEnvironment(ctx context.Context, envId string) (func(), error) {
+	if d.StorePath == "" {
+		return func() {}, nil
+	}
+	dir := filepath.Join(d.StorePath, lockDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, envId+".lock")
+
+	logged := false
+	for {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			fmt.Fprintf(file, "%s %d\n", d.MachineName, os.Getpid())
+			file.Close()
+			done := make(chan struct{})
+			go refreshLock(path, lockRefreshInterval, done)
+			return func() {
+				close(done)
+				if err := os.Remove(path); err != nil {
+					log.Warnf("Unable to release lock %s: %s", path, err)
+				}
+			}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > staleLockAge {
+			if err := removeStaleLock(path); err != nil {
+				log.Warnf("Unable to remove stale lock %s: %s", path, err)
+			}
+			continue
+		}
+		if !logged {
+			log.Infof("Waiting for another machine to finish changing environment %s", envId)
+			logged = true
+		}
+		if err := sleepContext(ctx, lockRetryInterval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// removeStaleLock removes a lock file found to be stale. Another machine may
+// have removed it first and taken the lock since, so the file is moved aside
+// to a name only this process uses and checked again before it is removed; a
+// fresh lock moved aside is put back.
+func removeStaleLock(path string) error {
+	aside := fmt.Sprintf("%s.stale-%d-%d", path, os.Getpid(), time.Now().UnixNano())
+	if err := os.Rename(path, aside); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	info, err := os.Stat(aside)
+	if err != nil {
+		return err
+	}
+	if time.Since(info.ModTime()) <= staleLockAge {
+		if err = os.Link(aside, path); err != nil {
+			return err
+		}
+		return os.Remove(aside)
+	}
+	log.Warnf("Removing stale lock %s", path)
+	return os.Remove(aside)
+}
+
+// refreshLock touches a held lock file every interval until done is closed.
+func refreshLock(path string, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			if err := os.Chtimes(path, now, now); err != nil {
+				log.Warnf("Unable to refresh lock %s: %s", path, err)
+			}
+		}
+	}
+}
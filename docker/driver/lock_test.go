@@ -0,0 +1,139 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newLockTestDriver(t *testing.T) (*Driver, func()) {
+	storePath, err := ioutil.TempDir("", "skytap-lock-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDriver(testMachineName, storePath).(*Driver)
+	return d, func() { os.RemoveAll(storePath) }
+}
+
+func TestLockEnvironmentWaitsForHolder(t *testing.T) {
+	d, cleanup := newLockTestDriver(t)
+	defer cleanup()
+	unlock, err := d.lockEnvironment(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = d.lockEnvironment(ctx, "1"); err != context.DeadlineExceeded {
+		t.Errorf("locking a held environment returned %v, want a timeout", err)
+	}
+	other, err := d.lockEnvironment(context.Background(), "2")
+	if err != nil {
+		t.Fatalf("locking another environment: %s", err)
+	}
+	other()
+
+	unlock()
+	again, err := d.lockEnvironment(context.Background(), "1")
+	if err != nil {
+		t.Fatalf("locking a released environment: %s", err)
+	}
+	again()
+}
+
+func TestLockEnvironmentRemovesStaleLock(t *testing.T) {
+	d, cleanup := newLockTestDriver(t)
+	defer cleanup()
+	dir := filepath.Join(d.StorePath, lockDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "1.lock")
+	if err := ioutil.WriteFile(path, []byte("crashed 1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * staleLockAge)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	unlock, err := d.lockEnvironment(ctx, "1")
+	if err != nil {
+		t.Fatalf("stale lock was not taken over: %s", err)
+	}
+	unlock()
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("%d files left in the lock directory, want none", len(files))
+	}
+}
+
+func TestRemoveStaleLockKeepsReplacedLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "skytap-lock-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "1.lock")
+	// Another machine removed the stale lock and took the lock after this
+	// one found it stale.
+	if err = ioutil.WriteFile(path, []byte("other 2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = removeStaleLock(path); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "other 2\n" {
+		t.Errorf("lock file holds %q (%v), want the other machine's lock", data, err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("%d files left in the lock directory, want 1", len(files))
+	}
+}
+
+func TestLockEnvironmentRefreshesHeldLock(t *testing.T) {
+	defer func(interval time.Duration) { lockRefreshInterval = interval }(lockRefreshInterval)
+	lockRefreshInterval = 10 * time.Millisecond
+	d, cleanup := newLockTestDriver(t)
+	defer cleanup()
+
+	unlock, err := d.lockEnvironment(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	path := filepath.Join(d.StorePath, lockDir, "1.lock")
+	old := time.Now().Add(-2 * staleLockAge)
+	if err = os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(info.ModTime()) > staleLockAge {
+		t.Error("held lock was not refreshed")
+	}
+}
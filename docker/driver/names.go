@@ -0,0 +1,80 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/skytap/skytap-sdk-go/api"
+)
+
+type namedResource struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// findIdByName returns the ID of the one resource listed at path whose name
+// is exactly name. Skytap's name query matches substrings, so the listed
+// resources are filtered again here.
+func findIdByName(client api.SkytapClient, kind, path, name string) (string, error) {
+	var resources []namedResource
+	query := url.Values{"query": {"name:" + name}}
+	if err := skytapRequest(client, "GET", path+"?"+query.Encode(), nil, &resources); err != nil {
+		return "", err
+	}
+
+	var ids []string
+	for _, resource := range resources {
+		if resource.Name == name {
+			ids = append(ids, resource.Id)
+		}
+	}
+	switch len(ids) {
+	case 0:
+		return "", fmt.Errorf("No %s named '%s' found", kind, name)
+	case 1:
+		log.Debugf("Resolved %s '%s' to ID %s", kind, name, ids[0])
+		return ids[0], nil
+	}
+	return "", fmt.Errorf("More than one %s named '%s' (IDs %s), select it by ID instead", kind, name, strings.Join(ids, ", "))
+}
+
+// resolveNames looks up the IDs of the template, environment and VPN given
+// by name. IDs already resolved are kept, so it is safe to call more than
+// once.
+func (d *Driver) resolveNames(client api.SkytapClient) error {
+	config := &d.DeviceConfig
+	var err error
+	if config.TemplateName != "" && config.TemplateId == "" {
+		if config.TemplateId, err = findIdByName(client, "template", "/templates", config.TemplateName); err != nil {
+			return err
+		}
+	}
+	if config.EnvironmentName != "" && config.EnvironmentId == defaultEnvironmentId {
+		if config.EnvironmentId, err = findIdByName(client, "environment", "/configurations", config.EnvironmentName); err != nil {
+			config.EnvironmentId = defaultEnvironmentId
+			return err
+		}
+	}
+	if config.VPNName != "" && config.VPNId == defaultVPNId {
+		if config.VPNId, err = findIdByName(client, "VPN", "/vpns", config.VPNName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
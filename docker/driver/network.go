@@ -0,0 +1,222 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"fmt"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/skytap/skytap-sdk-go/api"
+)
+
+// networkSelected reports whether the user chose a specific environment
+// network rather than relying on the first one.
+func (d *Driver) networkSelected() bool {
+	return d.DeviceConfig.NetworkId != "" || d.DeviceConfig.NetworkName != ""
+}
+
+// selectNetwork returns the index in env.Networks of the network chosen with
+// --skytap-network-id or --skytap-network-name, or of the first network if
+// neither was given.
+func (d *Driver) selectNetwork(env *api.Environment) (int, error) {
+	return d.selectNetworkIn(env.Networks, "environment "+env.Id)
+}
+
+// selectNetworkIn is selectNetwork for the networks of the given template or
+// environment.
+func (d *Driver) selectNetworkIn(networks []api.Network, owner string) (int, error) {
+	if len(networks) == 0 {
+		return -1, fmt.Errorf("No networks in %s", owner)
+	}
+	if !d.networkSelected() {
+		return 0, nil
+	}
+
+	found := -1
+	for i, network := range networks {
+		if d.DeviceConfig.NetworkId != "" {
+			if network.Id == d.DeviceConfig.NetworkId {
+				return i, nil
+			}
+			continue
+		}
+		if network.Name == d.DeviceConfig.NetworkName {
+			if found != -1 {
+				return -1, fmt.Errorf("More than one network named '%s' in %s, use --skytap-network-id instead", network.Name, owner)
+			}
+			found = i
+		}
+	}
+	if found == -1 {
+		return -1, fmt.Errorf("Network '%s%s' not found in %s", d.DeviceConfig.NetworkId, d.DeviceConfig.NetworkName, owner)
+	}
+	return found, nil
+}
+
+// checkSourceNetwork verifies that the network chosen with
+// --skytap-network-name will exist in the environment created for the
+// machine, which copies the networks of the template the source VM belongs
+// to, or otherwise of the environment it is in.
+func (d *Driver) checkSourceNetwork(client api.SkytapClient, source *machineSource) error {
+	templateId := source.templateId
+	if templateId == "" {
+		template, err := source.vm.GetTemplate(client)
+		if err != nil {
+			return err
+		}
+		if template != nil {
+			templateId = template.Id
+		}
+	}
+	if templateId != "" {
+		template, err := getTemplate(client, templateId)
+		if err != nil {
+			return err
+		}
+		_, err = d.selectNetworkIn(template.Networks, "template "+template.Id)
+		return err
+	}
+
+	env, err := source.vm.GetEnvironment(client)
+	if err != nil {
+		return err
+	}
+	if env == nil {
+		return fmt.Errorf("VM %s is not in a template or environment", source.vm.Id)
+	}
+	_, err = d.selectNetwork(env)
+	return err
+}
+
+// checkInterfaceIndex verifies the VM has the interface chosen with
+// --skytap-interface-index.
+func (d *Driver) checkInterfaceIndex(vm *api.VirtualMachine) error {
+	if d.DeviceConfig.InterfaceIndex >= len(vm.Interfaces) {
+		return fmt.Errorf("Interface index %d requested but VM %s has %d network interfaces", d.DeviceConfig.InterfaceIndex, vm.Id, len(vm.Interfaces))
+	}
+	return nil
+}
+
+// icnrTunnel is an inter-configuration network route between two networks.
+type icnrTunnel struct {
+	Id            string      `json:"id"`
+	Status        string      `json:"status"`
+	SourceNetwork networkLink `json:"source_network"`
+	TargetNetwork networkLink `json:"target_network"`
+}
+
+type networkLink struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// findTunnel returns the existing tunnel between an environment network and
+// the target network, or nil if there is none.
+func findTunnel(client api.SkytapClient, envId, networkId, targetNetworkId string) (*icnrTunnel, error) {
+	var network struct {
+		Tunnels []icnrTunnel `json:"tunnels"`
+	}
+	path := fmt.Sprintf("/configurations/%s/networks/%s", envId, networkId)
+	if err := skytapRequest(client, "GET", path, nil, &network); err != nil {
+		return nil, err
+	}
+	for _, tunnel := range network.Tunnels {
+		if (tunnel.SourceNetwork.Id == networkId && tunnel.TargetNetwork.Id == targetNetworkId) ||
+			(tunnel.SourceNetwork.Id == targetNetworkId && tunnel.TargetNetwork.Id == networkId) {
+			return &tunnel, nil
+		}
+	}
+	return nil, nil
+}
+
+func createTunnel(client api.SkytapClient, sourceNetworkId, targetNetworkId string) (*icnrTunnel, error) {
+	var tunnel icnrTunnel
+	params := map[string]string{"source_network_id": sourceNetworkId, "target_network_id": targetNetworkId}
+	if err := skytapRequest(client, "POST", "/tunnels", params, &tunnel); err != nil {
+		return nil, err
+	}
+	return &tunnel, nil
+}
+
+func deleteTunnel(client api.SkytapClient, tunnelId string) error {
+	return skytapRequest(client, "DELETE", fmt.Sprintf("/tunnels/%s", tunnelId), nil, nil)
+}
+
+// connectIcnr connects the selected network of the environment to the ICNR
+// target network, reusing an existing tunnel between them. A tunnel created
+// here is recorded in the driver only if the environment was created for
+// this machine, so that Remove deletes it along with the environment. In an
+// existing environment the tunnel is left to the environment, like a VPN
+// attachment, since other machines there come to rely on it.
+func (d *Driver) connectIcnr(client api.SkytapClient, env *api.Environment, rollback *rollbackLog) error {
+	selected, err := d.selectNetwork(env)
+	if err != nil {
+		return err
+	}
+	networkId := env.Networks[selected].Id
+	targetId := d.DeviceConfig.ICNRTargetNetworkId
+
+	existing, err := findTunnel(client, env.Id, networkId, targetId)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		log.Infof("Using existing ICNR tunnel %s to network %s", existing.Id, targetId)
+		return nil
+	}
+
+	log.Infof("Connecting network %s to network %s with ICNR", networkId, targetId)
+	tunnel, err := createTunnel(client, networkId, targetId)
+	if err != nil {
+		return err
+	}
+	if d.OwnsEnvironment {
+		d.ICNRTunnelId = tunnel.Id
+	} else {
+		log.Infof("ICNR tunnel %s will stay with environment %s when this machine is removed", tunnel.Id, env.Id)
+	}
+	rollback.add("create ICNR tunnel "+tunnel.Id, func() error {
+		if err := deleteTunnel(client, tunnel.Id); err != nil {
+			return err
+		}
+		d.ICNRTunnelId = ""
+		return nil
+	})
+	return nil
+}
+
+// icnrAddress returns the address through which the ICNR target network
+// reaches the interface: its NAT address for that network if the route uses
+// NAT, otherwise the interface's own IP.
+func (d *Driver) icnrAddress(client api.SkytapClient, nicId, nicIp string) (string, error) {
+	var details struct {
+		NatAddresses struct {
+			NetworkNatAddresses []struct {
+				NetworkId string `json:"network_id"`
+				IpAddress string `json:"ip_address"`
+			} `json:"network_nat_addresses"`
+		} `json:"nat_addresses"`
+	}
+	path := fmt.Sprintf("/configurations/%s/vms/%s/interfaces/%s", d.DeviceConfig.EnvironmentId, d.Vm.Id, nicId)
+	if err := skytapRequest(client, "GET", path, nil, &details); err != nil {
+		return "", err
+	}
+	for _, nat := range details.NatAddresses.NetworkNatAddresses {
+		if nat.NetworkId == d.DeviceConfig.ICNRTargetNetworkId {
+			return nat.IpAddress, nil
+		}
+	}
+	return nicIp, nil
+}
@@ -0,0 +1,193 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIcnrTunnelOwnership(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing bool
+		// others is the number of other VMs in the machine's environment
+		// when it is removed.
+		others       int
+		wantRecorded bool
+		wantKept     bool
+	}{
+		{name: "own environment", wantRecorded: true, wantKept: false},
+		{name: "own environment with other VMs", others: 1, wantRecorded: true, wantKept: true},
+		{name: "existing environment", existing: true, wantRecorded: false, wantKept: true},
+		{name: "existing environment with other VMs", existing: true, others: 1, wantRecorded: false, wantKept: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			target, _ := e.server.AddEnvironment("office")
+			template, _ := e.server.AddTemplate("golden", "docker")
+			flags := map[string]interface{}{
+				"skytap-template-id":         template.Id,
+				"skytap-icnr-target-network": target.Networks[0].Id,
+			}
+			if test.existing {
+				shared, _ := e.server.AddEnvironment("shared")
+				flags["skytap-env-id"] = shared.Id
+			}
+			d := e.create(flags)
+
+			if recorded := d.ICNRTunnelId != ""; recorded != test.wantRecorded {
+				t.Errorf("tunnel recorded: %t, want %t", recorded, test.wantRecorded)
+			}
+			if !strings.HasPrefix(d.IPAddress, "192.168.") {
+				t.Errorf("IP address %q, want the ICNR NAT address", d.IPAddress)
+			}
+			for i := 0; i < test.others; i++ {
+				e.server.AddVM(d.DeviceConfig.EnvironmentId, "other")
+			}
+
+			if err := d.Remove(); err != nil {
+				t.Fatal(err)
+			}
+
+			e.server.Lock()
+			defer e.server.Unlock()
+			if kept := len(e.server.Tunnels) == 1; kept != test.wantKept {
+				t.Errorf("tunnel kept: %t, want %t", kept, test.wantKept)
+			}
+		})
+	}
+}
+
+func TestCreateUsesSelectedNetwork(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	template, vms := e.server.AddTemplate("golden", "docker")
+	data := e.server.AddNetwork(template.Id, "data")
+	e.server.AddInterface(vms[0].Id, data.Id)
+	vpn := e.server.AddVpn("office")
+
+	d := e.create(map[string]interface{}{
+		"skytap-template-id":     template.Id,
+		"skytap-vpn-id":          vpn.Id,
+		"skytap-network-name":    "data",
+		"skytap-interface-index": 1,
+	})
+
+	env := e.environment(d.DeviceConfig.EnvironmentId)
+	for _, network := range env.Networks {
+		attached := len(network.VpnAttachments) == 1 && network.VpnAttachments[0].Connected
+		if attached != (network.Name == "data") {
+			t.Errorf("VPN attachments of network %s are %+v", network.Name, network.VpnAttachments)
+		}
+	}
+	vm := e.vm(d.Vm.Id)
+	if vm.Interfaces[0].NatAddresses.VpnNatAddresses != nil {
+		t.Errorf("first interface, on network %s, got VPN NAT addresses", vm.Interfaces[0].NetworkId)
+	}
+	nat := vm.Interfaces[1].NatAddresses.VpnNatAddresses
+	if len(nat) != 1 || d.IPAddress != nat[0].IpAddress {
+		t.Errorf("IP address %q, want the data interface's VPN NAT address in %+v", d.IPAddress, nat)
+	}
+}
+
+func TestPreCreateCheckValidatesNetwork(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(e *testEnv) map[string]interface{}
+		wantErr string
+	}{
+		{
+			name: "template network",
+			setup: func(e *testEnv) map[string]interface{} {
+				flags := e.templateFlags()
+				e.server.AddNetwork(flags["skytap-template-id"].(string), "data")
+				flags["skytap-network-name"] = "data"
+				return flags
+			},
+		},
+		{
+			name: "missing template network",
+			setup: func(e *testEnv) map[string]interface{} {
+				flags := e.templateFlags()
+				flags["skytap-network-name"] = "data"
+				return flags
+			},
+			wantErr: "Network 'data' not found in template",
+		},
+		{
+			name: "source environment network",
+			setup: func(e *testEnv) map[string]interface{} {
+				e.server.AddPublicIp(testPublicIp)
+				env, vms := e.server.AddEnvironment("source", "docker")
+				e.server.AddNetwork(env.Id, "data")
+				return map[string]interface{}{"skytap-vm-id": vms[0].Id, "skytap-public-ip": publicIpAuto, "skytap-network-name": "data"}
+			},
+		},
+		{
+			name: "missing source environment network",
+			setup: func(e *testEnv) map[string]interface{} {
+				e.server.AddPublicIp(testPublicIp)
+				_, vms := e.server.AddEnvironment("source", "docker")
+				return map[string]interface{}{"skytap-vm-id": vms[0].Id, "skytap-public-ip": publicIpAuto, "skytap-network-name": "data"}
+			},
+			wantErr: "Network 'data' not found in environment",
+		},
+		{
+			name: "existing environment network ID",
+			setup: func(e *testEnv) map[string]interface{} {
+				env, _ := e.server.AddEnvironment("shared")
+				flags := e.templateFlags()
+				flags["skytap-env-id"] = env.Id
+				flags["skytap-network-id"] = env.Networks[0].Id
+				return flags
+			},
+		},
+		{
+			name: "missing existing environment network ID",
+			setup: func(e *testEnv) map[string]interface{} {
+				env, _ := e.server.AddEnvironment("shared")
+				flags := e.templateFlags()
+				flags["skytap-env-id"] = env.Id
+				flags["skytap-network-id"] = "net-missing"
+				return flags
+			},
+			wantErr: "Network 'net-missing' not found in environment",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			d := e.driver(test.setup(e))
+			checkError(t, d.PreCreateCheck(), test.wantErr)
+		})
+	}
+}
+
+func TestNetworkIdRequiresExistingEnvironment(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	template, _ := e.server.AddTemplate("golden", "docker")
+	flags := map[string]interface{}{"skytap-template-id": template.Id, "skytap-network-id": "net-" + template.Id}
+
+	_, err := e.configure(flags)
+
+	checkError(t, err, "A network ID only applies to an existing environment")
+}
@@ -0,0 +1,212 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/docker/machine/libmachine/state"
+	"github.com/skytap/skytap-sdk-go/api"
+)
+
+// Skytap runstates the SDK has no constant for.
+const (
+	// runStateHalted is reported for a VM whose guest OS shut itself down.
+	runStateHalted = "halted"
+	// runStateReset is reported while a VM is being reset.
+	runStateReset = "reset"
+)
+
+const defaultStopTimeout = 300
+
+// Runstate transitions recorded in Driver.LastAction.
+const (
+	actionStart = "start"
+	actionStop  = "stop"
+)
+
+// Values of --skytap-stop-mode.
+const (
+	stopModeShutdown = "shutdown"
+	stopModeSuspend  = "suspend"
+)
+
+// runstateToState maps a Skytap VM runstate other than busy onto a libmachine
+// state. Runstates added to Skytap after this was written map to state.Error
+// rather than failing, so that listing machines keeps working.
+func runstateToState(runstate string) state.State {
+	switch runstate {
+	case api.RunStateStart:
+		return state.Running
+	case api.RunStateStop, runStateHalted:
+		return state.Stopped
+	case api.RunStatePause:
+		return state.Paused
+	case runStateReset:
+		return state.Starting
+	}
+	log.Warnf("Unknown Skytap VM runstate '%s'", runstate)
+	return state.Error
+}
+
+// vmState maps a Skytap VM runstate onto a libmachine state. docker-machine
+// stop waits for the machine to be stopped, so with --skytap-stop-mode=suspend
+// a VM the driver suspended is reported stopped; one suspended any other way
+// is paused.
+func (d *Driver) vmState(runstate string) state.State {
+	switch {
+	case runstate == api.RunStateBusy:
+		return d.busyState()
+	case runstate == api.RunStatePause && d.StopMode == stopModeSuspend && d.LastAction == actionStop:
+		return state.Stopped
+	}
+	return runstateToState(runstate)
+}
+
+func validateStopMode(mode string) error {
+	switch mode {
+	case "", stopModeShutdown, stopModeSuspend:
+		return nil
+	}
+	return fmt.Errorf("Invalid stop mode '%s', must be '%s' or '%s'", mode, stopModeShutdown, stopModeSuspend)
+}
+
+// suspendVm suspends a VM, keeping its memory state so that starting it
+// again resumes where it left off.
+func suspendVm(client api.SkytapClient, vmId string) error {
+	return skytapRequest(client, "PUT", fmt.Sprintf("/vms/%s", vmId), map[string]string{"runstate": api.RunStatePause}, nil)
+}
+
+// settledVm fetches the VM, waiting up to --skytap-busy-wait seconds for it
+// to stop being busy. A VM that is still busy afterwards is returned as is.
+func (d *Driver) settledVm(client api.SkytapClient) (*api.VirtualMachine, error) {
+	if d.BusyWait <= 0 {
+		return api.GetVirtualMachine(client, d.Vm.Id)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(d.BusyWait)*time.Second)
+	defer cancel()
+	vm, err := waitForVm(ctx, client, d.Vm.Id)
+	if err == context.DeadlineExceeded {
+		return api.GetVirtualMachine(client, d.Vm.Id)
+	}
+	return vm, err
+}
+
+// busyState returns the state a busy VM is moving to, judging by the last
+// transition the driver requested. Skytap also reports VMs as busy while
+// they are being created or changed, so without a stop request they are
+// assumed to be starting.
+func (d *Driver) busyState() state.State {
+	if d.LastAction == actionStop {
+		return state.Stopping
+	}
+	return state.Starting
+}
+
+// waitForRunstate polls a VM until Skytap reports the given runstate. A halted
+// VM counts as stopped.
+func waitForRunstate(ctx context.Context, client api.SkytapClient, vmId, runstate string) (*api.VirtualMachine, error) {
+	for {
+		vm, err := api.GetVirtualMachine(client, vmId)
+		if err != nil {
+			return nil, err
+		}
+		if vm.Runstate == runstate || (runstate == api.RunStateStop && vm.Runstate == runStateHalted) {
+			return vm, nil
+		}
+		log.Debugf("VM %s is %s, waiting %s for it to be %s", vmId, vm.Runstate, pollInterval, runstate)
+		if err = sleepContext(ctx, pollInterval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// shutdown asks the guest OS to shut down and waits until Skytap reports the
+// VM stopped. If that takes longer than the stop timeout, the VM is powered
+// off instead.
+func (d *Driver) shutdown(client api.SkytapClient) error {
+	d.LastAction = actionStop
+	if _, err := d.Vm.Stop(client); err != nil {
+		return err
+	}
+	timeout := d.stopTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, err := waitForRunstate(ctx, client, d.Vm.Id, api.RunStateStop)
+	if err != context.DeadlineExceeded {
+		return err
+	}
+
+	log.Warnf("VM %s did not shut down within %s, powering it off", d.Vm.Id, timeout)
+	if _, err := d.Vm.Kill(client); err != nil {
+		return err
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), d.phaseTimeout())
+	defer cancel()
+	if _, err = waitForRunstate(ctx, client, d.Vm.Id, api.RunStateStop); err == context.DeadlineExceeded {
+		return fmt.Errorf("VM %s was powered off but is still not stopped after %s", d.Vm.Id, d.phaseTimeout())
+	}
+	return err
+}
+
+// suspend suspends the VM and waits until Skytap reports it suspended.
+func (d *Driver) suspend(client api.SkytapClient) error {
+	d.LastAction = actionStop
+	if err := suspendVm(client, d.Vm.Id); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.stopTimeout())
+	defer cancel()
+	_, err := waitForRunstate(ctx, client, d.Vm.Id, api.RunStatePause)
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf("VM %s did not suspend within %s", d.Vm.Id, d.stopTimeout())
+	}
+	return err
+}
+
+// waitForDocker waits until the machine accepts SSH connections and the
+// Docker daemon's port accepts TCP connections.
+func (d *Driver) waitForDocker(ctx context.Context) error {
+	for {
+		err := probeMachine(d)
+		if err == nil {
+			return nil
+		}
+		log.Debugf("Machine is not reachable yet, waiting %s: %s", pollInterval, err)
+		if ctxErr := sleepContext(ctx, pollInterval); ctxErr != nil {
+			return err
+		}
+	}
+}
+
+func (d *Driver) probeDocker() error {
+	if _, err := runSSHCommand(d, "exit 0"); err != nil {
+		return fmt.Errorf("SSH is not available: %s", err)
+	}
+	conn, err := net.DialTimeout("tcp", d.dockerAddress(d.IPAddress), 10*time.Second)
+	if err != nil {
+		return fmt.Errorf("Docker daemon is not reachable: %s", err)
+	}
+	conn.Close()
+	return nil
+}
+
+func (d *Driver) stopTimeout() time.Duration {
+	return secondsOrDefault(d.StopTimeout, defaultStopTimeout)
+}
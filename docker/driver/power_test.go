@@ -0,0 +1,216 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/machine/libmachine/state"
+	"github.com/skytap/docker-machine-driver-skytap/docker/driver/skytaptest"
+)
+
+func TestBusyState(t *testing.T) {
+	tests := map[string]state.State{
+		"":          state.Starting,
+		actionStart: state.Starting,
+		actionStop:  state.Stopping,
+	}
+	for lastAction, want := range tests {
+		d := &Driver{LastAction: lastAction}
+		if got := d.busyState(); got != want {
+			t.Errorf("busy after %q reported %s, want %s", lastAction, got, want)
+		}
+	}
+}
+
+func TestGetStateBusyWait(t *testing.T) {
+	busy := skytaptest.RunStateBusy
+	tests := []struct {
+		name      string
+		busyWait  int
+		runstates []string
+		want      state.State
+	}{
+		{"no wait", 0, []string{busy, busy, skytaptest.RunStateStopped}, state.Stopping},
+		{"VM settles", 1, []string{busy, busy, skytaptest.RunStateStopped}, state.Stopped},
+		{"VM stays busy", 1, []string{busy}, state.Stopping},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			_, vms := e.server.AddEnvironment("env", "docker")
+			e.setRunstate(vms[0].Id, test.runstates...)
+			d := e.driver(map[string]interface{}{"skytap-vm-id": vms[0].Id, "skytap-busy-wait": test.busyWait})
+			d.Vm.Id = vms[0].Id
+			d.LastAction = actionStop
+
+			got, err := d.GetState()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("state %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPowerOperationsRecordLastAction(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	d := e.create(e.templateFlags())
+	if d.LastAction != actionStart {
+		t.Errorf("after Create last action is %q, want %q", d.LastAction, actionStart)
+	}
+
+	steps := []struct {
+		name    string
+		operate func(d *Driver) error
+		want    string
+	}{
+		{"Stop", (*Driver).Stop, actionStop},
+		{"Start", (*Driver).Start, actionStart},
+		{"Kill", (*Driver).Kill, actionStop},
+	}
+	for _, step := range steps {
+		if err := step.operate(d); err != nil {
+			t.Fatalf("%s: %s", step.name, err)
+		}
+		if d.LastAction != step.want {
+			t.Errorf("after %s last action is %q, want %q", step.name, d.LastAction, step.want)
+		}
+	}
+}
+
+// runstateRecorder records the runstates requested of a VM and the machine's
+// LastState each time the VM is polled. With ignoreShutdown, guest OS
+// shutdown requests are accepted without being passed on, as for a guest
+// that never shuts down.
+type runstateRecorder struct {
+	sync.Mutex
+	d              *Driver
+	next           http.RoundTripper
+	ignoreShutdown bool
+	requested      []string
+	lastStates     []state.State
+}
+
+func (t *runstateRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasPrefix(req.URL.Path, "/vms/") {
+		return t.next.RoundTrip(req)
+	}
+	t.Lock()
+	defer t.Unlock()
+	if req.Method == "GET" {
+		t.lastStates = append(t.lastStates, t.d.LastState)
+	}
+	if req.Method == "PUT" && req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		var params struct{ Runstate string }
+		json.Unmarshal(body, &params)
+		t.requested = append(t.requested, params.Runstate)
+		if t.ignoreShutdown && params.Runstate == skytaptest.RunStateStopped {
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("{}"))}, nil
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+func recordRunstates(d *Driver, ignoreShutdown bool) *runstateRecorder {
+	recorder := &runstateRecorder{d: d, next: d.HTTPClient.Transport, ignoreShutdown: ignoreShutdown}
+	d.HTTPClient = &http.Client{Transport: recorder}
+	return recorder
+}
+
+func TestStopShutsDownGuest(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	d := e.create(e.templateFlags())
+	e.server.TransitionPolls = 3
+	recorder := recordRunstates(d, false)
+
+	if err := d.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(recorder.requested, " ") != skytaptest.RunStateStopped {
+		t.Errorf("requested runstates %v, want only a shutdown", recorder.requested)
+	}
+	if len(recorder.lastStates) == 0 {
+		t.Fatal("Stop did not wait for the VM to stop")
+	}
+	for i, lastState := range recorder.lastStates {
+		if lastState == state.Stopped {
+			t.Errorf("poll %d saw the machine recorded as stopped before Skytap reported it", i+1)
+		}
+	}
+	if d.LastState != state.Stopped {
+		t.Errorf("last state %s, want %s", d.LastState, state.Stopped)
+	}
+}
+
+func TestStopPowersOffAfterTimeout(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	flags := e.templateFlags()
+	flags["skytap-stop-timeout"] = 1
+	d := e.create(flags)
+	recorder := recordRunstates(d, true)
+
+	if err := d.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{skytaptest.RunStateStopped, skytaptest.RunStateHalted}
+	if strings.Join(recorder.requested, " ") != strings.Join(want, " ") {
+		t.Errorf("requested runstates %v, want %v", recorder.requested, want)
+	}
+	if runstate := e.vm(d.Vm.Id).Runstate; runstate != skytaptest.RunStateStopped {
+		t.Errorf("VM is %s, want %s", runstate, skytaptest.RunStateStopped)
+	}
+	if d.LastState != state.Stopped {
+		t.Errorf("last state %s, want %s", d.LastState, state.Stopped)
+	}
+}
+
+func TestStopFailureIsNotRecordedAsStopped(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	d := e.create(e.templateFlags())
+	e.server.FailNext("PUT", "/vms/"+d.Vm.Id, http.StatusBadRequest, 1)
+
+	if err := d.Stop(); err == nil {
+		t.Fatal("Stop succeeded although Skytap refused it")
+	}
+
+	if d.LastState == state.Stopped {
+		t.Errorf("last state %s after a failed stop", d.LastState)
+	}
+	if runstate := e.vm(d.Vm.Id).Runstate; runstate != skytaptest.RunStateRunning {
+		t.Errorf("VM is %s, want %s", runstate, skytaptest.RunStateRunning)
+	}
+}
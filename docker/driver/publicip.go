@@ -0,0 +1,220 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/skytap/skytap-sdk-go/api"
+)
+
+const (
+	// publicIpAuto attaches the first available public IP of the account.
+	publicIpAuto = "auto"
+	// publicIpServices publishes the SSH and Docker ports as Skytap
+	// published services instead of attaching a public IP.
+	publicIpServices = "services"
+
+	dockerPort = 2376
+)
+
+type publicIp struct {
+	Id      string        `json:"id"`
+	Address string        `json:"address"`
+	Nics    []interface{} `json:"nics"`
+}
+
+type publishedService struct {
+	Id           string `json:"id"`
+	InternalPort int    `json:"internal_port"`
+	ExternalIp   string `json:"external_ip"`
+	ExternalPort int    `json:"external_port"`
+}
+
+func listPublicIps(client api.SkytapClient) ([]publicIp, error) {
+	var ips []publicIp
+	err := skytapRequest(client, "GET", "/ips", nil, &ips)
+	return ips, err
+}
+
+func interfacePath(envId, vmId, nicId string) string {
+	return fmt.Sprintf("/configurations/%s/vms/%s/interfaces/%s", envId, vmId, nicId)
+}
+
+func attachPublicIp(client api.SkytapClient, envId, vmId, nicId, address string) error {
+	return skytapRequest(client, "POST", interfacePath(envId, vmId, nicId)+"/ips", map[string]string{"ip": address}, nil)
+}
+
+func detachPublicIp(client api.SkytapClient, envId, vmId, nicId, address string) error {
+	return skytapRequest(client, "DELETE", interfacePath(envId, vmId, nicId)+"/ips/"+address, nil, nil)
+}
+
+func publishService(client api.SkytapClient, envId, vmId, nicId string, port int) (*publishedService, error) {
+	var service publishedService
+	err := skytapRequest(client, "POST", interfacePath(envId, vmId, nicId)+"/services", map[string]int{"port": port}, &service)
+	if err != nil {
+		return nil, err
+	}
+	return &service, nil
+}
+
+func deleteService(client api.SkytapClient, envId, vmId, nicId, serviceId string) error {
+	return skytapRequest(client, "DELETE", interfacePath(envId, vmId, nicId)+"/services/"+serviceId, nil, nil)
+}
+
+// checkPublicIp verifies a public IP can be attached as requested with
+// --skytap-public-ip.
+func (d *Driver) checkPublicIp(client api.SkytapClient) error {
+	mode := d.PublicIpMode
+	if mode == "" || mode == publicIpServices {
+		return nil
+	}
+	ips, err := listPublicIps(client)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if len(ip.Nics) == 0 && (mode == publicIpAuto || ip.Address == mode) {
+			return nil
+		}
+		if ip.Address == mode {
+			return fmt.Errorf("Public IP %s is already attached to another VM", mode)
+		}
+	}
+	if mode == publicIpAuto {
+		return fmt.Errorf("No unattached public IP available in this Skytap account")
+	}
+	return fmt.Errorf("Public IP %s not found in this Skytap account", mode)
+}
+
+// exposePublicly makes the VM's interface reachable from the internet as
+// requested with --skytap-public-ip, either by attaching a public IP or by
+// publishing the SSH and Docker ports as services. What was attached is
+// recorded in the driver so that Remove can release it.
+func (d *Driver) exposePublicly(client api.SkytapClient, envId string, vm *api.VirtualMachine, nicId string, rollback *rollbackLog) error {
+	switch d.PublicIpMode {
+	case "":
+		return nil
+	case publicIpServices:
+		for _, port := range []int{d.SSHPort, dockerPort} {
+			service, err := publishService(client, envId, vm.Id, nicId, port)
+			if err != nil {
+				return err
+			}
+			log.Infof("Published port %d as %s:%d", port, service.ExternalIp, service.ExternalPort)
+			d.PublishedServices = append(d.PublishedServices, *service)
+			serviceId := service.Id
+			rollback.add(fmt.Sprintf("publish port %d", port), func() error {
+				return deleteService(client, envId, vm.Id, nicId, serviceId)
+			})
+		}
+		return nil
+	}
+
+	candidates := []string{d.PublicIpMode}
+	if d.PublicIpMode == publicIpAuto {
+		ips, err := listPublicIps(client)
+		if err != nil {
+			return err
+		}
+		candidates = nil
+		for _, ip := range ips {
+			if len(ip.Nics) == 0 {
+				candidates = append(candidates, ip.Address)
+			}
+		}
+	}
+
+	// Another machine may claim an available IP first, so move on to the next
+	// candidate if attaching fails.
+	var err error
+	for _, address := range candidates {
+		if err = attachPublicIp(client, envId, vm.Id, nicId, address); err != nil {
+			log.Infof("Unable to attach public IP %s: %s", address, err)
+			continue
+		}
+		log.Infof("Attached public IP %s", address)
+		d.PublicIp = address
+		rollback.add("attach public IP "+address, func() error {
+			return detachPublicIp(client, envId, vm.Id, nicId, address)
+		})
+		return nil
+	}
+	if err == nil {
+		err = fmt.Errorf("No unattached public IP available in this Skytap account")
+	}
+	return err
+}
+
+// releasePublicAccess detaches the public IP and deletes the published
+// services that Create set up for the machine. Any already gone, for example
+// along with the VM, count as released.
+func (d *Driver) releasePublicAccess(client api.SkytapClient) error {
+	if d.PublicIp == "" && len(d.PublishedServices) == 0 {
+		return nil
+	}
+	if err := d.checkInterfaceIndex(&d.Vm); err != nil {
+		return err
+	}
+	nicId := d.Vm.Interfaces[d.DeviceConfig.InterfaceIndex].Id
+	envId := d.DeviceConfig.EnvironmentId
+
+	if d.PublicIp != "" {
+		log.Infof("Releasing public IP %s", d.PublicIp)
+		if err := detachPublicIp(client, envId, d.Vm.Id, nicId, d.PublicIp); err != nil && !isNotFound(err) {
+			return err
+		}
+		d.PublicIp = ""
+	}
+	for len(d.PublishedServices) > 0 {
+		service := d.PublishedServices[0]
+		log.Infof("Deleting published service for port %d", service.InternalPort)
+		if err := deleteService(client, envId, d.Vm.Id, nicId, service.Id); err != nil && !isNotFound(err) {
+			return err
+		}
+		d.PublishedServices = d.PublishedServices[1:]
+	}
+	return nil
+}
+
+// publishedAddress returns the external address and port through which the
+// given VM port is published, if it is.
+func (d *Driver) publishedAddress(port int) (string, int, bool) {
+	for _, service := range d.PublishedServices {
+		if service.InternalPort == port {
+			return service.ExternalIp, service.ExternalPort, true
+		}
+	}
+	return "", 0, false
+}
+
+// GetSSHPort returns the port docker-machine connects to for SSH, which is
+// the published service's external port when SSH is published.
+func (d *Driver) GetSSHPort() (int, error) {
+	if _, port, ok := d.publishedAddress(d.SSHPort); ok {
+		return port, nil
+	}
+	return d.BaseDriver.GetSSHPort()
+}
+
+// dockerAddress returns the host:port at which the Docker daemon is reached.
+func (d *Driver) dockerAddress(ip string) string {
+	if host, port, ok := d.publishedAddress(dockerPort); ok {
+		return net.JoinHostPort(host, fmt.Sprintf("%d", port))
+	}
+	return net.JoinHostPort(ip, fmt.Sprintf("%d", dockerPort))
+}
@@ -0,0 +1,105 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/skytap/skytap-sdk-go/api"
+)
+
+// Resize changes the CPUs and RAM of the machine's VM to those set in hc,
+// leaving unset ones as they are. Skytap only changes the hardware of a
+// powered off VM, so a running VM is shut down first and started again
+// afterwards. A suspended VM is refused rather than powered off, which would
+// lose its memory state. The new hardware is recorded in HardwareConfig.
+func (d *Driver) Resize(hc api.Hardware) error {
+	d.SetLogLevel()
+	if hc.Cpus == nil && hc.CpusPerSocket == nil && hc.Ram == nil {
+		return errors.New("No CPU or RAM change requested")
+	}
+	if err := validateHardware(hc); err != nil {
+		return err
+	}
+
+	client := d.client()
+	hardware, err := getHardware(client, &machineSource{vm: &d.Vm})
+	if err != nil {
+		return err
+	}
+	if err = checkHardwareConfig(hc, hardware); err != nil {
+		return err
+	}
+	if hc.Cpus != nil && hc.CpusPerSocket == nil && hardware.CpusPerSocket > 0 && *hc.Cpus%hardware.CpusPerSocket != 0 {
+		return fmt.Errorf("Specified CPUs (%d) must be a multiple of the VM's CPUs per socket (%d)", *hc.Cpus, hardware.CpusPerSocket)
+	}
+
+	// The runstate is checked rather than GetState, which reports a VM
+	// suspended by stop as stopped.
+	current, err := d.settledVm(client)
+	if err != nil {
+		return err
+	}
+	running := current.Runstate == api.RunStateStart
+	switch current.Runstate {
+	case api.RunStateStop, runStateHalted:
+	case api.RunStateStart:
+		log.Infof("Stopping VM %s to change its hardware", d.Vm.Id)
+		if err = d.stop(stopModeShutdown); err != nil {
+			return err
+		}
+	case api.RunStatePause:
+		return fmt.Errorf("VM %s is suspended, start it and stop it with --skytap-stop-mode %s before resizing it", d.Vm.Id, stopModeShutdown)
+	default:
+		return fmt.Errorf("VM %s is %s, it must be running or stopped to be resized", d.Vm.Id, d.vmState(current.Runstate))
+	}
+
+	log.Infof("Updating hardware of VM %s", d.Vm.Id)
+	if _, err = d.Vm.UpdateHardware(client, hc, false); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.phaseTimeout())
+	defer cancel()
+	vm, err := waitForVm(ctx, client, d.Vm.Id)
+	if err != nil {
+		return err
+	}
+	d.Vm = *vm
+	d.recordHardware(hc)
+
+	if running {
+		return d.Start()
+	}
+	return nil
+}
+
+// recordHardware merges the hardware settings in hc into HardwareConfig.
+func (d *Driver) recordHardware(hc api.Hardware) {
+	if d.HardwareConfig == nil {
+		d.HardwareConfig = &api.Hardware{}
+	}
+	if hc.Cpus != nil {
+		d.HardwareConfig.Cpus = hc.Cpus
+	}
+	if hc.CpusPerSocket != nil {
+		d.HardwareConfig.CpusPerSocket = hc.CpusPerSocket
+	}
+	if hc.Ram != nil {
+		d.HardwareConfig.Ram = hc.Ram
+	}
+}
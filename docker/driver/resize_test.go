@@ -0,0 +1,119 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/skytap/docker-machine-driver-skytap/docker/driver/skytaptest"
+	"github.com/skytap/skytap-sdk-go/api"
+)
+
+func TestResize(t *testing.T) {
+	tests := []struct {
+		name string
+		// stop brings the machine into the runstate Resize starts from.
+		stop     func(d *Driver) error
+		wantErr  string
+		wantCpus string
+		// runstate is the VM's runstate after Resize.
+		runstate string
+	}{
+		{
+			// The fake API refuses to change the hardware of a VM that is
+			// not stopped, so this is stopped, resized and started again.
+			name:     "running",
+			stop:     func(d *Driver) error { return nil },
+			wantCpus: "2",
+			runstate: skytaptest.RunStateRunning,
+		},
+		{
+			name:     "stopped",
+			stop:     (*Driver).Stop,
+			wantCpus: "2",
+			runstate: skytaptest.RunStateStopped,
+		},
+		{
+			name: "suspended",
+			stop: func(d *Driver) error {
+				d.StopMode = stopModeSuspend
+				return d.Stop()
+			},
+			wantErr:  "is suspended",
+			wantCpus: "1",
+			runstate: skytaptest.RunStateSuspended,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			d := e.create(e.templateFlags())
+			if err := test.stop(d); err != nil {
+				t.Fatal(err)
+			}
+
+			cpus := 2
+			err := d.Resize(api.Hardware{Cpus: &cpus})
+			checkError(t, err, test.wantErr)
+
+			vm := e.vm(d.Vm.Id)
+			e.server.Lock()
+			defer e.server.Unlock()
+			if got := fmt.Sprint(vm.Hardware["cpus"]); got != test.wantCpus {
+				t.Errorf("VM has %s CPUs, want %s", got, test.wantCpus)
+			}
+			if vm.Runstate != test.runstate {
+				t.Errorf("VM is %s, want %s", vm.Runstate, test.runstate)
+			}
+			resized := d.HardwareConfig != nil && d.HardwareConfig.Cpus != nil && *d.HardwareConfig.Cpus == cpus
+			if resized != (test.wantErr == "") {
+				t.Errorf("recorded hardware %+v", d.HardwareConfig)
+			}
+		})
+	}
+}
+
+func TestResizeRequiresChange(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	d := e.create(e.templateFlags())
+
+	checkError(t, d.Resize(api.Hardware{}), "No CPU or RAM change requested")
+}
+
+func TestRecordHardwarePersists(t *testing.T) {
+	ram, cpus := 2048, 4
+	d := NewDriver(testMachineName, "").(*Driver)
+	d.HardwareConfig = &api.Hardware{Ram: &ram}
+
+	d.recordHardware(api.Hardware{Cpus: &cpus})
+
+	data, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := &Driver{}
+	if err = json.Unmarshal(data, loaded); err != nil {
+		t.Fatal(err)
+	}
+	hc := loaded.HardwareConfig
+	if hc == nil || hc.Cpus == nil || *hc.Cpus != cpus || hc.Ram == nil || *hc.Ram != ram || hc.CpusPerSocket != nil {
+		t.Errorf("saved hardware %+v, want %d CPUs and %d MB of RAM", hc, cpus, ram)
+	}
+}
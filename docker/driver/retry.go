@@ -0,0 +1,232 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+const (
+	defaultApiMaxRetries = 5
+	defaultApiBackoff    = 2
+	maxApiBackoff        = time.Minute
+)
+
+// jitter is seeded per process, so that machines created in parallel by
+// separate driver processes do not pick the same delays.
+var jitter = struct {
+	sync.Mutex
+	rand *rand.Rand
+}{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// ErrorClass groups failed Skytap API requests by how they may be retried.
+type ErrorClass int
+
+const (
+	// ErrorPermanent failures are returned to the caller straight away.
+	ErrorPermanent ErrorClass = iota
+	// ErrorBusy means the resource was busy or locked by another operation.
+	ErrorBusy
+	// ErrorRateLimited means the account exceeded Skytap's request rate.
+	ErrorRateLimited
+	// ErrorServer means Skytap failed to handle the request.
+	ErrorServer
+	// ErrorNetwork means no response was received.
+	ErrorNetwork
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorBusy:
+		return "busy or locked"
+	case ErrorRateLimited:
+		return "rate limited"
+	case ErrorServer:
+		return "server error"
+	case ErrorNetwork:
+		return "network error"
+	}
+	return "permanent error"
+}
+
+// RetryPolicy decides whether, and after how long, a failed Skytap API
+// request is retried.
+type RetryPolicy interface {
+	// Backoff is called after the given attempt (starting at 1) failed with
+	// the given class of error. It returns the delay before the next attempt,
+	// or false to give up.
+	Backoff(attempt int, class ErrorClass) (time.Duration, bool)
+}
+
+// ExponentialBackoff retries every non-permanent error up to MaxRetries
+// times, doubling the delay from Base up to Max and adding random jitter so
+// that concurrent machines do not retry in lockstep.
+type ExponentialBackoff struct {
+	MaxRetries int
+	Base       time.Duration
+	Max        time.Duration
+}
+
+func (b ExponentialBackoff) Backoff(attempt int, class ErrorClass) (time.Duration, bool) {
+	if class == ErrorPermanent || attempt > b.MaxRetries || b.Base <= 0 {
+		return 0, false
+	}
+	delay := b.Base
+	for i := 1; i < attempt && delay < b.Max; i++ {
+		delay *= 2
+	}
+	if b.Max > 0 && delay > b.Max {
+		delay = b.Max
+	}
+	// Wait somewhere between half and all of the computed delay.
+	half := int64(delay / 2)
+	jitter.Lock()
+	defer jitter.Unlock()
+	return time.Duration(half + jitter.rand.Int63n(half+1)), true
+}
+
+// ClassifyStatus returns the class of error a Skytap API status code represents.
+func ClassifyStatus(status int) ErrorClass {
+	switch {
+	case status == http.StatusConflict || status == http.StatusLocked:
+		return ErrorBusy
+	case status == http.StatusTooManyRequests:
+		return ErrorRateLimited
+	case status >= 500:
+		return ErrorServer
+	}
+	return ErrorPermanent
+}
+
+func (d *Driver) retryPolicy() RetryPolicy {
+	if d.RetryPolicy != nil {
+		return d.RetryPolicy
+	}
+	return ExponentialBackoff{
+		MaxRetries: d.ApiMaxRetries,
+		Base:       secondsOrDefault(d.ApiBackoff, defaultApiBackoff),
+		Max:        maxApiBackoff,
+	}
+}
+
+// retryTransport retries Skytap API requests according to a RetryPolicy.
+// Server and network errors are only retried for idempotent methods, since
+// Skytap may already have acted on the failed request. A non-zero timeout
+// limits each attempt, including reading its response body, so that a slow
+// attempt is retried rather than using up the time left for the others.
+type retryTransport struct {
+	policy  RetryPolicy
+	timeout time.Duration
+	next    http.RoundTripper
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := req.Context(), context.CancelFunc(func() {})
+		if t.timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		}
+		attemptReq := req.WithContext(ctx)
+		if body != nil {
+			attemptReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		resp, err := t.next.RoundTrip(attemptReq)
+		if err != nil {
+			cancel()
+		} else {
+			resp.Body = &cancelBody{resp.Body, cancel}
+		}
+
+		class := ErrorNetwork
+		if err == nil {
+			class = ClassifyStatus(resp.StatusCode)
+		}
+		if class == ErrorPermanent || ((class == ErrorServer || class == ErrorNetwork) && !idempotent(req.Method)) {
+			return resp, err
+		}
+		delay, retry := t.policy.Backoff(attempt, class)
+		if !retry {
+			return resp, err
+		}
+		if resp != nil {
+			if after := retryAfter(resp); after > delay {
+				delay = after
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		log.Infof("Skytap API %s %s failed (%s), retrying in %s", req.Method, req.URL.Path, class, delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// cancelBody releases an attempt's timeout once its response body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+// retryAfter returns the delay requested by a Retry-After header in seconds.
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	delay := time.Duration(seconds) * time.Second
+	if delay > maxApiBackoff {
+		delay = maxApiBackoff
+	}
+	return delay
+}
@@ -0,0 +1,185 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	policy := ExponentialBackoff{MaxRetries: 4, Base: time.Second, Max: 4 * time.Second}
+	tests := []struct {
+		attempt int
+		class   ErrorClass
+		retry   bool
+		// max is the delay before jitter, which takes off up to half.
+		max time.Duration
+	}{
+		{1, ErrorBusy, true, time.Second},
+		{2, ErrorRateLimited, true, 2 * time.Second},
+		{3, ErrorServer, true, 4 * time.Second},
+		{4, ErrorNetwork, true, 4 * time.Second},
+		{5, ErrorBusy, false, 0},
+		{1, ErrorPermanent, false, 0},
+	}
+
+	for _, test := range tests {
+		for i := 0; i < 20; i++ {
+			delay, retry := policy.Backoff(test.attempt, test.class)
+			if retry != test.retry {
+				t.Fatalf("attempt %d, %s: retry %t, want %t", test.attempt, test.class, retry, test.retry)
+			}
+			if delay < test.max/2 || delay > test.max {
+				t.Fatalf("attempt %d, %s: delay %s outside %s to %s", test.attempt, test.class, delay, test.max/2, test.max)
+			}
+		}
+	}
+}
+
+func TestClassifyStatus(t *testing.T) {
+	tests := map[int]ErrorClass{
+		http.StatusOK:                  ErrorPermanent,
+		http.StatusNotFound:            ErrorPermanent,
+		http.StatusUnprocessableEntity: ErrorPermanent,
+		http.StatusConflict:            ErrorBusy,
+		http.StatusLocked:              ErrorBusy,
+		http.StatusTooManyRequests:     ErrorRateLimited,
+		http.StatusInternalServerError: ErrorServer,
+		http.StatusServiceUnavailable:  ErrorServer,
+	}
+	for status, want := range tests {
+		if got := ClassifyStatus(status); got != want {
+			t.Errorf("status %d classified as %s, want %s", status, got, want)
+		}
+	}
+}
+
+// scriptedTransport answers requests with the given statuses in turn, an
+// error status of 0 standing for a network error, and records the bodies it
+// was sent.
+type scriptedTransport struct {
+	statuses []int
+	bodies   []string
+}
+
+func (t *scriptedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := ""
+	if req.Body != nil {
+		data, _ := ioutil.ReadAll(req.Body)
+		body = string(data)
+	}
+	t.bodies = append(t.bodies, body)
+
+	status := t.statuses[0]
+	if len(t.statuses) > 1 {
+		t.statuses = t.statuses[1:]
+	}
+	if status == 0 {
+		return nil, errors.New("connection reset")
+	}
+	return &http.Response{StatusCode: status, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+}
+
+func TestRetryTransport(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		statuses   []int
+		wantStatus int
+		wantTries  int
+	}{
+		{"busy PUT is retried", "PUT", []int{http.StatusLocked, http.StatusConflict, http.StatusOK}, http.StatusOK, 3},
+		{"busy POST is retried", "POST", []int{http.StatusLocked, http.StatusOK}, http.StatusOK, 2},
+		{"rate limited POST is retried", "POST", []int{http.StatusTooManyRequests, http.StatusOK}, http.StatusOK, 2},
+		{"server error GET is retried", "GET", []int{http.StatusBadGateway, 0, http.StatusOK}, http.StatusOK, 3},
+		{"server error POST is not retried", "POST", []int{http.StatusInternalServerError, http.StatusOK}, http.StatusInternalServerError, 1},
+		{"network error POST is not retried", "POST", []int{0, http.StatusOK}, 0, 1},
+		{"permanent error is not retried", "PUT", []int{http.StatusNotFound, http.StatusOK}, http.StatusNotFound, 1},
+		{"retries run out", "GET", []int{http.StatusLocked}, http.StatusLocked, 4},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := &scriptedTransport{statuses: test.statuses}
+			transport := &retryTransport{
+				policy: ExponentialBackoff{MaxRetries: 3, Base: time.Millisecond, Max: time.Millisecond},
+				next:   next,
+			}
+			req, _ := http.NewRequest(test.method, "https://cloud.skytap.com/vms/1", strings.NewReader(`{"runstate":"running"}`))
+
+			resp, err := transport.RoundTrip(req)
+
+			status := 0
+			if err == nil {
+				status = resp.StatusCode
+			}
+			if status != test.wantStatus {
+				t.Errorf("status %d (error %v), want %d", status, err, test.wantStatus)
+			}
+			if len(next.bodies) != test.wantTries {
+				t.Errorf("%d attempts, want %d", len(next.bodies), test.wantTries)
+			}
+			for i, body := range next.bodies {
+				if body != `{"runstate":"running"}` {
+					t.Errorf("attempt %d sent body %q", i+1, body)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryTransportTimesOutEachAttempt(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			// Hang until the attempt times out.
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	transport := &retryTransport{
+		policy:  ExponentialBackoff{MaxRetries: 3, Base: time.Millisecond, Max: time.Millisecond},
+		timeout: 100 * time.Millisecond,
+		next:    http.DefaultTransport,
+	}
+	req, _ := http.NewRequest("GET", server.URL, nil)
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip: %s", err)
+	}
+	defer resp.Body.Close()
+	// The second attempt's timeout must still allow its body to be read.
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(body) != "ok" {
+		t.Errorf("body %q (error %v), want \"ok\"", body, err)
+	}
+	if n := atomic.LoadInt32(&attempts); n != 2 {
+		t.Errorf("%d attempts, want 2", n)
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"github.com/docker/machine/libmachine/log"
+)
+
+// rollbackLog records the side effects of Create as they happen, so that a
+// failed create can undo them in reverse order.
+type rollbackLog struct {
+	steps []rollbackStep
+}
+
+type rollbackStep struct {
+	description string
+	undo        func() error
+}
+
+// add records a completed side effect together with the function that undoes it.
+func (r *rollbackLog) add(description string, undo func() error) {
+	log.Debugf("Recorded for rollback: %s", description)
+	r.steps = append(r.steps, rollbackStep{description, undo})
+}
+
+// unwind undoes every recorded step, most recent first. A failing step is
+// logged and does not stop the remaining steps from running.
+func (r *rollbackLog) unwind() {
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		step := r.steps[i]
+		log.Infof("Rolling back: %s", step.description)
+		if err := step.undo(); err != nil {
+			log.Warnf("Unable to roll back '%s', the resource may need to be removed manually: %s", step.description, err)
+		}
+	}
+	r.steps = nil
+}
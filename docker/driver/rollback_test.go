@@ -0,0 +1,77 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRollbackUnwindsInReverseOrder(t *testing.T) {
+	var undone []string
+	rollback := &rollbackLog{}
+	for _, name := range []string{"environment", "vpn", "vm"} {
+		name := name
+		rollback.add(name, func() error {
+			undone = append(undone, name)
+			return nil
+		})
+	}
+
+	rollback.unwind()
+
+	if want := []string{"vm", "vpn", "environment"}; !reflect.DeepEqual(undone, want) {
+		t.Errorf("undone %v, want %v", undone, want)
+	}
+}
+
+func TestRollbackContinuesAfterFailedStep(t *testing.T) {
+	var undone []string
+	rollback := &rollbackLog{}
+	rollback.add("first", func() error {
+		undone = append(undone, "first")
+		return nil
+	})
+	rollback.add("second", func() error {
+		return errors.New("still busy")
+	})
+	rollback.add("third", func() error {
+		undone = append(undone, "third")
+		return nil
+	})
+
+	rollback.unwind()
+
+	if want := []string{"third", "first"}; !reflect.DeepEqual(undone, want) {
+		t.Errorf("undone %v, want %v", undone, want)
+	}
+}
+
+func TestRollbackUnwindsOnlyOnce(t *testing.T) {
+	calls := 0
+	rollback := &rollbackLog{}
+	rollback.add("step", func() error {
+		calls++
+		return nil
+	})
+
+	rollback.unwind()
+	rollback.unwind()
+
+	if calls != 1 {
+		t.Errorf("undo called %d times, want 1", calls)
+	}
+}
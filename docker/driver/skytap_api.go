@@ -0,0 +1,147 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/skytap/skytap-sdk-go/api"
+)
+
+const skytapApiUrl = "https://cloud.skytap.com"
+
+// apiError is returned when the Skytap API answers a request made through
+// skytapRequest with a non-2xx status code.
+type apiError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Message    string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("Skytap API %s %s failed with status %d: %s", e.Method, e.Path, e.StatusCode, e.Message)
+}
+
+// skytapRequest performs a JSON request against a Skytap REST endpoint that the
+// SDK does not cover, using the credentials and HTTP client of the given
+// SkytapClient. If result is non-nil the response body is decoded into it.
+func skytapRequest(client api.SkytapClient, method, path string, body, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, skytapApiUrl+path, reader)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(client.Credentials.Username, client.Credentials.ApiKey)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+
+	httpClient := client.HttpClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	log.Debugf("Skytap API request: %s %s", method, path)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &apiError{
+			Method:     method,
+			Path:       path,
+			StatusCode: resp.StatusCode,
+			Message:    errorMessage(data),
+		}
+	}
+	if result != nil && len(data) > 0 {
+		return json.Unmarshal(data, result)
+	}
+	return nil
+}
+
+// errorMessage extracts the error text from a Skytap error response body.
+func errorMessage(body []byte) string {
+	var payload struct {
+		Error  string   `json:"error"`
+		Errors []string `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &payload); err == nil {
+		if payload.Error != "" {
+			return payload.Error
+		}
+		if len(payload.Errors) > 0 {
+			return payload.Errors[0]
+		}
+	}
+	return string(body)
+}
+
+func deleteEnvironment(client api.SkytapClient, envId string) error {
+	return skytapRequest(client, "DELETE", fmt.Sprintf("/configurations/%s", envId), nil, nil)
+}
+
+func getEnvironment(client api.SkytapClient, envId string) (*api.Environment, error) {
+	env := &api.Environment{}
+	if err := skytapRequest(client, "GET", fmt.Sprintf("/configurations/%s", envId), nil, env); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+func deleteVm(client api.SkytapClient, vmId string) error {
+	return skytapRequest(client, "DELETE", fmt.Sprintf("/vms/%s", vmId), nil, nil)
+}
+
+func disconnectVpn(client api.SkytapClient, envId, networkId, vpnId string) error {
+	path := fmt.Sprintf("/configurations/%s/networks/%s/vpns/%s", envId, networkId, vpnId)
+	return skytapRequest(client, "PUT", path, map[string]bool{"connected": false}, nil)
+}
+
+func detachVpn(client api.SkytapClient, envId, networkId, vpnId string) error {
+	path := fmt.Sprintf("/configurations/%s/networks/%s/vpns/%s", envId, networkId, vpnId)
+	return skytapRequest(client, "DELETE", path, nil, nil)
+}
+
+func updateEnvironment(client api.SkytapClient, envId string, params map[string]string) error {
+	return skytapRequest(client, "PUT", fmt.Sprintf("/configurations/%s", envId), params, nil)
+}
+
+func checkProject(client api.SkytapClient, projectId string) error {
+	return skytapRequest(client, "GET", fmt.Sprintf("/projects/%s", projectId), nil, nil)
+}
+
+func addEnvironmentToProject(client api.SkytapClient, projectId, envId string) error {
+	return skytapRequest(client, "POST", fmt.Sprintf("/projects/%s/configurations/%s", projectId, envId), nil, nil)
+}
@@ -0,0 +1,1394 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package skytaptest provides an in-process stand-in for the parts of the
+// Skytap REST API used by the driver, so the driver can be exercised end to
+// end without a live Skytap account.
+package skytaptest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	RunStateRunning   = "running"
+	RunStateStopped   = "stopped"
+	RunStateSuspended = "suspended"
+	RunStateHalted    = "halted"
+	RunStateBusy      = "busy"
+)
+
+// Server is a fake Skytap API backed by in-memory state. All exported fields
+// of the resources it holds may be changed between requests by a test, as long
+// as the server's Lock/Unlock methods guard the change.
+type Server struct {
+	*httptest.Server
+	sync.Mutex
+
+	VMs          map[string]*VM
+	Environments map[string]*Environment
+	Templates    map[string]*Template
+	Vpns         map[string]*Vpn
+	Tunnels      map[string]*Tunnel
+	Projects     map[string]*Project
+	PublicIps    map[string]*PublicIp
+	// Quotas are the account's quotas, reported by /company/quotas.
+	Quotas []*Quota
+
+	// TransitionPolls is the number of GET requests for which a VM reports
+	// busy after a runstate change, before reporting the requested runstate.
+	TransitionPolls int
+
+	requests []string
+	failures []*failure
+	nextId   int
+}
+
+type VM struct {
+	Id            string                 `json:"id"`
+	Name          string                 `json:"name"`
+	Runstate      string                 `json:"runstate"`
+	Hardware      map[string]interface{} `json:"hardware"`
+	Interfaces    []*Interface           `json:"interfaces"`
+	EnvironmentId string                 `json:"-"`
+	TemplateId    string                 `json:"-"`
+	// Credentials are returned by the credentials endpoint, in Skytap's
+	// "user / password" text form.
+	Credentials []string `json:"-"`
+	// Runstates, when not empty, are reported by successive GET requests
+	// before the VM falls back to its Runstate.
+	Runstates []string `json:"-"`
+	// Labels maps label categories to values.
+	Labels map[string]string `json:"-"`
+	// ConfigurationUrl and TemplateUrl link the VM to the environment or
+	// template holding it. They are filled in when the VM is reported.
+	ConfigurationUrl string `json:"configuration_url,omitempty"`
+	TemplateUrl      string `json:"template_url,omitempty"`
+}
+
+type Interface struct {
+	Id           string       `json:"id"`
+	Hostname     string       `json:"hostname"`
+	Ip           string       `json:"ip"`
+	NetworkId    string       `json:"network_id"`
+	NatAddresses NatAddresses `json:"nat_addresses"`
+	PublicIps    []*PublicIp  `json:"public_ips"`
+	Services     []*Service   `json:"services"`
+	// network is the name of the network the interface is on, which is
+	// how it finds its network again when its VM is copied.
+	network string
+}
+
+type PublicIp struct {
+	Id      string   `json:"id"`
+	Address string   `json:"address"`
+	Nics    []string `json:"nics"`
+}
+
+// Service is a published service exposing one port of an interface.
+type Service struct {
+	Id           string `json:"id"`
+	InternalPort int    `json:"internal_port"`
+	ExternalIp   string `json:"external_ip"`
+	ExternalPort int    `json:"external_port"`
+}
+
+type NatAddresses struct {
+	VpnNatAddresses     []VpnNatAddress     `json:"vpn_nat_addresses"`
+	NetworkNatAddresses []NetworkNatAddress `json:"network_nat_addresses"`
+}
+
+type VpnNatAddress struct {
+	VpnId     string `json:"vpn_id"`
+	IpAddress string `json:"ip_address"`
+}
+
+type NetworkNatAddress struct {
+	NetworkId string `json:"network_id"`
+	IpAddress string `json:"ip_address"`
+}
+
+type Environment struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	// Description is set with a PUT but not reported.
+	Description string     `json:"-"`
+	VmIds       []string   `json:"-"`
+	Networks    []*Network `json:"networks"`
+	Tags        []string   `json:"-"`
+	// Labels maps label categories to values.
+	Labels map[string]string `json:"-"`
+}
+
+type Network struct {
+	Id             string           `json:"id"`
+	Name           string           `json:"name"`
+	Subnet         string           `json:"subnet"`
+	VpnAttachments []*VpnAttachment `json:"vpn_attachments"`
+	Tunnels        []*Tunnel        `json:"tunnels"`
+}
+
+// Tunnel is an inter-configuration network route (ICNR).
+type Tunnel struct {
+	Id            string      `json:"id"`
+	Status        string      `json:"status"`
+	SourceNetwork NetworkLink `json:"source_network"`
+	TargetNetwork NetworkLink `json:"target_network"`
+}
+
+type NetworkLink struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type VpnAttachment struct {
+	Id        string `json:"id"`
+	Connected bool   `json:"connected"`
+	Vpn       *Vpn   `json:"vpn"`
+}
+
+type Template struct {
+	Id       string     `json:"id"`
+	Name     string     `json:"name"`
+	VmIds    []string   `json:"-"`
+	Networks []*Network `json:"networks"`
+}
+
+type Vpn struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type Project struct {
+	Id             string   `json:"id"`
+	Name           string   `json:"name"`
+	EnvironmentIds []string `json:"-"`
+}
+
+// Quota is an account quota. A nil Limit means the quota is unlimited.
+type Quota struct {
+	Id    string   `json:"id"`
+	Usage float64  `json:"usage"`
+	Limit *float64 `json:"limit"`
+	Units string   `json:"units"`
+}
+
+type failure struct {
+	method string
+	prefix string
+	status int
+	count  int
+}
+
+// NewServer starts a fake Skytap API with no resources. Callers should Close
+// it when done.
+func NewServer() *Server {
+	s := &Server{
+		VMs:          map[string]*VM{},
+		Environments: map[string]*Environment{},
+		Templates:    map[string]*Template{},
+		Vpns:         map[string]*Vpn{},
+		Tunnels:      map[string]*Tunnel{},
+		Projects:     map[string]*Project{},
+		PublicIps:    map[string]*PublicIp{},
+		nextId:       1000,
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Client returns an HTTP client that sends requests for any host, including
+// cloud.skytap.com, to this server.
+func (s *Server) Client() *http.Client {
+	target, _ := url.Parse(s.URL)
+	return &http.Client{Transport: &rewriteTransport{target, http.DefaultTransport}}
+}
+
+type rewriteTransport struct {
+	target *url.URL
+	// next is the transport the rewritten request is sent with, kept so
+	// that the client still works when it is installed as
+	// http.DefaultTransport.
+	next http.RoundTripper
+}
+
+func (t *rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rewritten := *req
+	u := *req.URL
+	u.Scheme = t.target.Scheme
+	u.Host = t.target.Host
+	rewritten.URL = &u
+	rewritten.Host = t.target.Host
+	return t.next.RoundTrip(&rewritten)
+}
+
+// AddVpn registers a VPN.
+func (s *Server) AddVpn(name string) *Vpn {
+	s.Lock()
+	defer s.Unlock()
+	vpn := &Vpn{Id: s.newId(), Name: name}
+	s.Vpns[vpn.Id] = vpn
+	return vpn
+}
+
+// AddProject registers an empty project.
+func (s *Server) AddProject(name string) *Project {
+	s.Lock()
+	defer s.Unlock()
+	project := &Project{Id: s.newId(), Name: name}
+	s.Projects[project.Id] = project
+	return project
+}
+
+// AddPublicIp registers an unattached public IP.
+func (s *Server) AddPublicIp(address string) *PublicIp {
+	s.Lock()
+	defer s.Unlock()
+	ip := &PublicIp{Id: "ip-" + address, Address: address, Nics: []string{}}
+	s.PublicIps[address] = ip
+	return ip
+}
+
+// AddTemplate registers a template holding one stopped VM per given name, and
+// returns the template along with its VMs.
+func (s *Server) AddTemplate(name string, vmNames ...string) (*Template, []*VM) {
+	s.Lock()
+	defer s.Unlock()
+	t := &Template{Id: s.newId(), Name: name}
+	t.Networks = []*Network{defaultNetwork(t.Id)}
+	var vms []*VM
+	for _, vmName := range vmNames {
+		vm := s.newVM(vmName)
+		vm.TemplateId = t.Id
+		t.VmIds = append(t.VmIds, vm.Id)
+		vms = append(vms, vm)
+	}
+	s.Templates[t.Id] = t
+	return t, vms
+}
+
+// AddEnvironment registers an environment with a single network holding one
+// stopped VM per given name, and returns the environment along with its VMs.
+func (s *Server) AddEnvironment(name string, vmNames ...string) (*Environment, []*VM) {
+	s.Lock()
+	defer s.Unlock()
+	env := s.newEnvironment(name)
+	var vms []*VM
+	for _, vmName := range vmNames {
+		vm := s.newVM(vmName)
+		s.addToEnvironment(env, vm)
+		vms = append(vms, vm)
+	}
+	return env, vms
+}
+
+// AddVM adds a stopped VM with the given name to an existing environment, as
+// another user or machine would.
+func (s *Server) AddVM(envId, name string) *VM {
+	s.Lock()
+	defer s.Unlock()
+	vm := s.newVM(name)
+	s.addToEnvironment(s.Environments[envId], vm)
+	return vm
+}
+
+// AddNetwork adds a network with the given name to a template or an
+// environment. VMs copied from a template or environment are connected to
+// the copy's networks of the same names.
+func (s *Server) AddNetwork(ownerId, name string) *Network {
+	s.Lock()
+	defer s.Unlock()
+	networks := s.networksOf(ownerId)
+	network := &Network{
+		Id:     fmt.Sprintf("net-%s-%d", ownerId, len(*networks)),
+		Name:   name,
+		Subnet: fmt.Sprintf("10.0.%d.0/24", len(*networks)),
+	}
+	*networks = append(*networks, network)
+	return network
+}
+
+// AddInterface adds a network interface on the given network of its
+// template or environment to a VM.
+func (s *Server) AddInterface(vmId, networkId string) *Interface {
+	s.Lock()
+	defer s.Unlock()
+	vm := s.VMs[vmId]
+	owner := vm.TemplateId
+	if vm.EnvironmentId != "" {
+		owner = vm.EnvironmentId
+	}
+	nic := &Interface{
+		Id:       fmt.Sprintf("nic-%s-%d", vm.Id, len(vm.Interfaces)),
+		Hostname: vm.Name,
+		Ip:       fmt.Sprintf("10.0.%d.%d", len(vm.Interfaces), s.nextId%250+2),
+	}
+	for _, network := range *s.networksOf(owner) {
+		if network.Id == networkId {
+			nic.network = network.Name
+			if vm.EnvironmentId != "" {
+				nic.NetworkId = network.Id
+			}
+		}
+	}
+	vm.Interfaces = append(vm.Interfaces, nic)
+	return nic
+}
+
+func (s *Server) networksOf(ownerId string) *[]*Network {
+	if t, ok := s.Templates[ownerId]; ok {
+		return &t.Networks
+	}
+	return &s.Environments[ownerId].Networks
+}
+
+func defaultNetwork(ownerId string) *Network {
+	return &Network{Id: "net-" + ownerId, Name: "Default Network", Subnet: "10.0.0.0/24"}
+}
+
+// AddQuota registers an account quota with the given usage and limit.
+func (s *Server) AddQuota(id string, usage, limit float64, units string) *Quota {
+	s.Lock()
+	defer s.Unlock()
+	quota := &Quota{Id: id, Usage: usage, Limit: &limit, Units: units}
+	s.Quotas = append(s.Quotas, quota)
+	return quota
+}
+
+// FailNext makes the next count requests whose method matches and whose path
+// starts with pathPrefix fail with the given HTTP status. An empty method
+// matches any method.
+func (s *Server) FailNext(method, pathPrefix string, status, count int) {
+	s.Lock()
+	defer s.Unlock()
+	s.failures = append(s.failures, &failure{method, pathPrefix, status, count})
+}
+
+// Requests returns every request served so far, as "METHOD /path" strings.
+func (s *Server) Requests() []string {
+	s.Lock()
+	defer s.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+func (s *Server) newId() string {
+	s.nextId++
+	return fmt.Sprintf("%d", s.nextId)
+}
+
+func (s *Server) newVM(name string) *VM {
+	vm := &VM{
+		Id:       s.newId(),
+		Name:     name,
+		Runstate: RunStateStopped,
+		Hardware: map[string]interface{}{
+			"cpus": 1, "cpus_per_socket": 1, "ram": 1024,
+			"max_cpus": 12, "max_ram": 131072, "supports_multicore": true,
+		},
+		Credentials: []string{"docker / tcuser"},
+	}
+	vm.Hardware["disks"] = []interface{}{newDisk(vm, 0, PrimaryDiskSize)}
+	vm.Interfaces = []*Interface{{Id: "nic-" + vm.Id, Hostname: name, Ip: fmt.Sprintf("10.0.0.%d", s.nextId%250+2)}}
+	s.VMs[vm.Id] = vm
+	return vm
+}
+
+// PrimaryDiskSize is the size in megabytes of the one disk new VMs have.
+const PrimaryDiskSize = 30720
+
+func newDisk(vm *VM, index int, size float64) map[string]interface{} {
+	return map[string]interface{}{"id": fmt.Sprintf("disk-%s-%d", vm.Id, index), "size": size, "type": "SCSI"}
+}
+
+// Disks returns the disks of a VM, primary disk first.
+func (vm *VM) Disks() []map[string]interface{} {
+	list, _ := vm.Hardware["disks"].([]interface{})
+	var disks []map[string]interface{}
+	for _, d := range list {
+		disks = append(disks, d.(map[string]interface{}))
+	}
+	return disks
+}
+
+// newEnvironment creates an environment with copies of the given networks,
+// or a single default network if there are none.
+func (s *Server) newEnvironment(name string, networks ...*Network) *Environment {
+	env := &Environment{Id: s.newId(), Name: name}
+	env.Networks = []*Network{defaultNetwork(env.Id)}
+	for i, network := range networks {
+		if i == 0 {
+			env.Networks[0].Name = network.Name
+			continue
+		}
+		env.Networks = append(env.Networks, &Network{
+			Id:     fmt.Sprintf("net-%s-%d", env.Id, i),
+			Name:   network.Name,
+			Subnet: network.Subnet,
+		})
+	}
+	s.Environments[env.Id] = env
+	return env
+}
+
+func (s *Server) addToEnvironment(env *Environment, vm *VM) {
+	vm.EnvironmentId = env.Id
+	for _, nic := range vm.Interfaces {
+		network := env.Networks[0]
+		for _, candidate := range env.Networks {
+			if candidate.Name == nic.network {
+				network = candidate
+			}
+		}
+		nic.NetworkId = network.Id
+		nic.network = network.Name
+		// A VM joining a network gets NAT addresses for the VPNs and routes
+		// already connected to it.
+		for _, attachment := range network.VpnAttachments {
+			nat := VpnNatAddress{VpnId: attachment.Vpn.Id, IpAddress: "172.16." + strings.TrimPrefix(nic.Ip, "10.0.")}
+			nic.NatAddresses.VpnNatAddresses = append(nic.NatAddresses.VpnNatAddresses, nat)
+		}
+		for _, tunnel := range network.Tunnels {
+			if tunnel.SourceNetwork.Id == network.Id {
+				nat := NetworkNatAddress{NetworkId: tunnel.TargetNetwork.Id, IpAddress: "192.168." + strings.TrimPrefix(nic.Ip, "10.0.")}
+				nic.NatAddresses.NetworkNatAddresses = append(nic.NatAddresses.NetworkNatAddresses, nat)
+			}
+		}
+	}
+	env.VmIds = append(env.VmIds, vm.Id)
+}
+
+// copyVM clones a template or environment VM into env.
+func (s *Server) copyVM(source *VM, env *Environment) *VM {
+	vm := s.cloneVM(source)
+	s.addToEnvironment(env, vm)
+	return vm
+}
+
+func (s *Server) cloneVM(source *VM) *VM {
+	vm := s.newVM(source.Name)
+	for k, v := range source.Hardware {
+		if k != "disks" {
+			vm.Hardware[k] = v
+		}
+	}
+	var disks []interface{}
+	for i, d := range source.Disks() {
+		disks = append(disks, newDisk(vm, i, d["size"].(float64)))
+	}
+	vm.Hardware["disks"] = disks
+	vm.Credentials = append([]string(nil), source.Credentials...)
+	for i, nic := range source.Interfaces {
+		if i == 0 {
+			vm.Interfaces[0].network = nic.network
+			continue
+		}
+		vm.Interfaces = append(vm.Interfaces, &Interface{
+			Id:       fmt.Sprintf("nic-%s-%d", vm.Id, i),
+			Hostname: nic.Hostname,
+			Ip:       fmt.Sprintf("10.0.%d.%d", i, s.nextId%250+2),
+			network:  nic.network,
+		})
+	}
+	return vm
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	path := strings.TrimSuffix(r.URL.Path, ".json")
+	s.requests = append(s.requests, r.Method+" "+path)
+
+	for _, f := range s.failures {
+		if f.count > 0 && (f.method == "" || f.method == r.Method) && strings.HasPrefix(path, f.prefix) {
+			f.count--
+			writeError(w, f.status, "injected failure")
+			return
+		}
+	}
+
+	params, err := requestParams(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if parts[0] == "v2" && len(parts) > 1 {
+		parts = parts[1:]
+	}
+	switch parts[0] {
+	case "vms":
+		s.serveVMs(w, r.Method, parts[1:], params)
+	case "configurations":
+		s.serveEnvironments(w, r.Method, parts[1:], params)
+	case "templates":
+		s.serveTemplates(w, r.Method, parts[1:], params)
+	case "vpns":
+		s.serveVpns(w, r.Method, parts[1:])
+	case "tunnels":
+		s.serveTunnels(w, r.Method, parts[1:], params)
+	case "projects":
+		s.serveProjects(w, r.Method, parts[1:])
+	case "company":
+		if len(parts) == 2 && parts[1] == "quotas" && r.Method == "GET" {
+			writeJSON(w, append([]*Quota{}, s.Quotas...))
+			return
+		}
+		writeError(w, http.StatusNotFound, "unknown endpoint "+path)
+	case "ips":
+		var ips []*PublicIp
+		for _, ip := range s.PublicIps {
+			ips = append(ips, ip)
+		}
+		writeJSON(w, ips)
+	default:
+		writeError(w, http.StatusNotFound, "unknown endpoint "+path)
+	}
+}
+
+func (s *Server) serveVMs(w http.ResponseWriter, method string, parts []string, params map[string]interface{}) {
+	if len(parts) == 0 {
+		writeError(w, http.StatusNotFound, "no VM specified")
+		return
+	}
+	vm, ok := s.VMs[parts[0]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such VM "+parts[0])
+		return
+	}
+	if len(parts) == 2 && parts[1] == "credentials" && method == "GET" {
+		var creds []map[string]string
+		for i, text := range vm.Credentials {
+			creds = append(creds, map[string]string{"id": fmt.Sprintf("%d", i), "text": text})
+		}
+		writeJSON(w, creds)
+		return
+	}
+	if len(parts) == 2 && parts[1] == "labels" && method == "PUT" {
+		if vm.Labels == nil {
+			vm.Labels = map[string]string{}
+		}
+		addLabels(vm.Labels, params)
+		writeJSON(w, vm.Labels)
+		return
+	}
+	if len(parts) != 1 {
+		writeError(w, http.StatusNotFound, "unknown VM endpoint")
+		return
+	}
+
+	switch method {
+	case "GET":
+		writeJSON(w, s.vmView(vm))
+	case "PUT":
+		if err := s.updateVM(vm, params); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		writeJSON(w, s.vmSnapshot(vm))
+	case "DELETE":
+		if s.vmBusy(vm) {
+			writeError(w, http.StatusLocked, "VM is busy")
+			return
+		}
+		s.deleteVM(vm)
+		writeJSON(w, map[string]string{})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, method)
+	}
+}
+
+func (s *Server) updateVM(vm *VM, params map[string]interface{}) error {
+	if name, ok := params["name"].(string); ok {
+		vm.Name = name
+	}
+	if hardware, ok := params["hardware"].(map[string]interface{}); ok {
+		if vm.Runstate != RunStateStopped {
+			return fmt.Errorf("VM must be stopped to change its hardware")
+		}
+		for k, v := range hardware {
+			if k == "disks" {
+				if err := changeDisks(vm, v); err != nil {
+					return err
+				}
+				continue
+			}
+			vm.Hardware[k] = v
+		}
+	}
+	if runstate, ok := params["runstate"].(string); ok {
+		switch runstate {
+		case RunStateRunning, RunStateStopped, RunStateSuspended, RunStateHalted:
+		default:
+			return fmt.Errorf("invalid runstate %s", runstate)
+		}
+		if runstate == RunStateHalted {
+			runstate = RunStateStopped
+		}
+		for i := 0; i < s.TransitionPolls; i++ {
+			vm.Runstates = append(vm.Runstates, RunStateBusy)
+		}
+		vm.Runstate = runstate
+	}
+	return nil
+}
+
+// changeDisks grows the existing disks and adds the new disks of a hardware
+// update.
+func changeDisks(vm *VM, value interface{}) error {
+	changes, _ := value.(map[string]interface{})
+	disks := vm.Disks()
+	existing, _ := changes["existing"].(map[string]interface{})
+	for id, change := range existing {
+		size, _ := change.(map[string]interface{})["size"].(float64)
+		found := false
+		for _, d := range disks {
+			if d["id"] == id {
+				if size < d["size"].(float64) {
+					return fmt.Errorf("disk %s cannot shrink", id)
+				}
+				d["size"] = size
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("no such disk %s", id)
+		}
+	}
+	added, _ := changes["new"].([]interface{})
+	for _, size := range added {
+		disks = append(disks, newDisk(vm, len(disks), size.(float64)))
+	}
+
+	list := make([]interface{}, len(disks))
+	for i, d := range disks {
+		list[i] = d
+	}
+	vm.Hardware["disks"] = list
+	return nil
+}
+
+// vmView returns the VM as a GET request reports it, consuming one scripted
+// runstate if any are queued.
+func (s *Server) vmView(vm *VM) *VM {
+	view := s.vmSnapshot(vm)
+	if len(vm.Runstates) > 0 {
+		vm.Runstates = vm.Runstates[1:]
+	}
+	return view
+}
+
+// vmSnapshot returns the VM as the API currently reports it, without
+// consuming any scripted runstate.
+func (s *Server) vmSnapshot(vm *VM) *VM {
+	view := *vm
+	if len(vm.Runstates) > 0 {
+		view.Runstate = vm.Runstates[0]
+	}
+	if vm.EnvironmentId != "" {
+		view.ConfigurationUrl = "https://cloud.skytap.com/configurations/" + vm.EnvironmentId
+	}
+	if vm.TemplateId != "" {
+		view.TemplateUrl = "https://cloud.skytap.com/templates/" + vm.TemplateId
+	}
+	return &view
+}
+
+func (s *Server) vmBusy(vm *VM) bool {
+	return len(vm.Runstates) > 0 && vm.Runstates[0] == RunStateBusy
+}
+
+// deleteVM deletes a VM, which releases the public IPs attached to its
+// interfaces as Skytap does.
+func (s *Server) deleteVM(vm *VM) {
+	delete(s.VMs, vm.Id)
+	for _, nic := range vm.Interfaces {
+		for _, ip := range s.PublicIps {
+			for i, nicId := range ip.Nics {
+				if nicId == nic.Id {
+					ip.Nics = append(ip.Nics[:i], ip.Nics[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	if env, ok := s.Environments[vm.EnvironmentId]; ok {
+		for i, id := range env.VmIds {
+			if id == vm.Id {
+				env.VmIds = append(env.VmIds[:i], env.VmIds[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func (s *Server) serveEnvironments(w http.ResponseWriter, method string, parts []string, params map[string]interface{}) {
+	if len(parts) == 0 {
+		switch method {
+		case "GET":
+			var envs []map[string]interface{}
+			for _, env := range s.Environments {
+				envs = append(envs, s.environmentView(env))
+			}
+			writeJSON(w, envs)
+		case "POST":
+			env, err := s.createEnvironment(params)
+			if err != nil {
+				writeError(w, http.StatusUnprocessableEntity, err.Error())
+				return
+			}
+			writeJSON(w, s.environmentView(env))
+		default:
+			writeError(w, http.StatusMethodNotAllowed, method)
+		}
+		return
+	}
+
+	env, ok := s.Environments[parts[0]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such environment "+parts[0])
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		s.serveEnvironment(w, method, env, params)
+	case len(parts) == 3 && parts[1] == "vms":
+		s.serveEnvironmentVM(w, method, env, parts[2], params)
+	case len(parts) >= 5 && parts[1] == "vms" && parts[3] == "interfaces":
+		s.serveInterface(w, method, env, parts[2], parts[4], parts[5:], params)
+	case len(parts) == 3 && parts[1] == "networks" && method == "GET":
+		for _, network := range env.Networks {
+			if network.Id == parts[2] {
+				writeJSON(w, network)
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, "no such network "+parts[2])
+	case len(parts) == 2 && parts[1] == "tags" && method == "PUT":
+		items, _ := params["items"].([]interface{})
+		for _, item := range items {
+			if tag, ok := item.(map[string]interface{}); ok {
+				if value, ok := tag["value"].(string); ok {
+					env.Tags = append(env.Tags, value)
+				}
+			}
+		}
+		writeJSON(w, env.Tags)
+	case len(parts) == 2 && parts[1] == "labels" && method == "PUT":
+		if env.Labels == nil {
+			env.Labels = map[string]string{}
+		}
+		addLabels(env.Labels, params)
+		writeJSON(w, env.Labels)
+	case len(parts) >= 4 && parts[1] == "networks" && parts[3] == "vpns":
+		s.serveVpnAttachment(w, method, env, parts[2], parts[4:], params)
+	default:
+		writeError(w, http.StatusNotFound, "unknown environment endpoint")
+	}
+}
+
+func (s *Server) serveEnvironment(w http.ResponseWriter, method string, env *Environment, params map[string]interface{}) {
+	switch method {
+	case "GET":
+		writeJSON(w, s.environmentView(env))
+	case "PUT":
+		if name, ok := params["name"].(string); ok {
+			env.Name = name
+		}
+		if description, ok := params["description"].(string); ok {
+			env.Description = description
+		}
+		if sourceId, ok := params["merge_configuration"].(string); ok {
+			source, ok := s.Environments[sourceId]
+			if !ok {
+				writeError(w, http.StatusNotFound, "no such environment "+sourceId)
+				return
+			}
+			for _, vmId := range stringList(params["vm_ids"], source.VmIds) {
+				vm, ok := s.VMs[vmId]
+				if !ok || vm.EnvironmentId != source.Id {
+					writeError(w, http.StatusUnprocessableEntity, "VM "+vmId+" is not in environment "+source.Id)
+					return
+				}
+				s.copyVM(vm, env)
+			}
+		}
+		if templateId, ok := params["template_id"].(string); ok {
+			t, ok := s.Templates[templateId]
+			if !ok {
+				writeError(w, http.StatusNotFound, "no such template "+templateId)
+				return
+			}
+			for _, vmId := range stringList(params["vm_ids"], t.VmIds) {
+				source, ok := s.VMs[vmId]
+				if !ok || source.TemplateId != t.Id {
+					writeError(w, http.StatusUnprocessableEntity, "VM "+vmId+" is not in template "+t.Id)
+					return
+				}
+				s.copyVM(source, env)
+			}
+		}
+		writeJSON(w, s.environmentView(env))
+	case "DELETE":
+		for _, vmId := range append([]string(nil), env.VmIds...) {
+			if vm, ok := s.VMs[vmId]; ok {
+				s.deleteVM(vm)
+			}
+		}
+		delete(s.Environments, env.Id)
+		writeJSON(w, map[string]string{})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, method)
+	}
+}
+
+// serveEnvironmentVM handles a VM addressed through its environment, which
+// is how its disks are changed.
+func (s *Server) serveEnvironmentVM(w http.ResponseWriter, method string, env *Environment, vmId string, params map[string]interface{}) {
+	vm, ok := s.VMs[vmId]
+	if !ok || vm.EnvironmentId != env.Id {
+		writeError(w, http.StatusNotFound, "no such VM "+vmId+" in environment "+env.Id)
+		return
+	}
+	switch method {
+	case "GET":
+		writeJSON(w, s.vmView(vm))
+	case "PUT":
+		if err := s.updateVM(vm, params); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		writeJSON(w, s.vmSnapshot(vm))
+	default:
+		writeError(w, http.StatusMethodNotAllowed, method)
+	}
+}
+
+// createEnvironment builds a new environment from a template or by copying
+// an existing environment, optionally restricted to some of its VMs.
+func (s *Server) createEnvironment(params map[string]interface{}) (*Environment, error) {
+	var sourceVms []string
+	var name string
+	var networks []*Network
+	if templateId, ok := params["template_id"].(string); ok {
+		t, ok := s.Templates[templateId]
+		if !ok {
+			return nil, fmt.Errorf("no such template %s", templateId)
+		}
+		sourceVms, name, networks = t.VmIds, t.Name, t.Networks
+	} else if envId, ok := params["configuration_id"].(string); ok {
+		source, ok := s.Environments[envId]
+		if !ok {
+			return nil, fmt.Errorf("no such environment %s", envId)
+		}
+		sourceVms, name, networks = source.VmIds, source.Name, source.Networks
+	} else {
+		return nil, fmt.Errorf("template_id or configuration_id is required")
+	}
+
+	env := s.newEnvironment(name, networks...)
+	for _, vmId := range stringList(params["vm_ids"], sourceVms) {
+		source, ok := s.VMs[vmId]
+		if !ok {
+			return nil, fmt.Errorf("no such VM %s", vmId)
+		}
+		s.copyVM(source, env)
+	}
+	return env, nil
+}
+
+func (s *Server) environmentView(env *Environment) map[string]interface{} {
+	var vms []*VM
+	runstates := map[string]bool{}
+	for _, vmId := range env.VmIds {
+		view := s.vmSnapshot(s.VMs[vmId])
+		runstates[view.Runstate] = true
+		vms = append(vms, view)
+	}
+
+	runstate := RunStateStopped
+	if runstates[RunStateBusy] {
+		runstate = RunStateBusy
+	} else if len(runstates) == 1 {
+		for r := range runstates {
+			runstate = r
+		}
+	} else if len(runstates) > 1 {
+		runstate = "mixed"
+	}
+
+	return map[string]interface{}{
+		"id":       env.Id,
+		"name":     env.Name,
+		"runstate": runstate,
+		"vms":      vms,
+		"networks": env.Networks,
+	}
+}
+
+func (s *Server) serveInterface(w http.ResponseWriter, method string, env *Environment, vmId, nicId string, rest []string, params map[string]interface{}) {
+	vm, ok := s.VMs[vmId]
+	if !ok || vm.EnvironmentId != env.Id {
+		writeError(w, http.StatusNotFound, "no such VM "+vmId)
+		return
+	}
+	for _, nic := range vm.Interfaces {
+		if nic.Id != nicId {
+			continue
+		}
+		if len(rest) > 0 {
+			s.serveInterfaceResource(w, method, nic, rest, params)
+			return
+		}
+		switch method {
+		case "GET":
+		case "PUT":
+			if hostname, ok := params["hostname"].(string); ok {
+				nic.Hostname = hostname
+			}
+		default:
+			writeError(w, http.StatusMethodNotAllowed, method)
+			return
+		}
+		writeJSON(w, nic)
+		return
+	}
+	writeError(w, http.StatusNotFound, "no such interface "+nicId)
+}
+
+// serveInterfaceResource handles the public IPs and published services of
+// an interface.
+func (s *Server) serveInterfaceResource(w http.ResponseWriter, method string, nic *Interface, rest []string, params map[string]interface{}) {
+	switch {
+	case rest[0] == "ips" && len(rest) == 1 && method == "POST":
+		address, _ := params["ip"].(string)
+		ip, ok := s.PublicIps[address]
+		if !ok {
+			writeError(w, http.StatusNotFound, "no such public IP "+address)
+			return
+		}
+		if len(ip.Nics) > 0 {
+			writeError(w, http.StatusUnprocessableEntity, "public IP is already attached")
+			return
+		}
+		ip.Nics = append(ip.Nics, nic.Id)
+		nic.PublicIps = append(nic.PublicIps, ip)
+		writeJSON(w, ip)
+	case rest[0] == "ips" && len(rest) == 2 && method == "DELETE":
+		for i, ip := range nic.PublicIps {
+			if ip.Address == rest[1] {
+				ip.Nics = []string{}
+				nic.PublicIps = append(nic.PublicIps[:i], nic.PublicIps[i+1:]...)
+				writeJSON(w, map[string]string{})
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, "public IP "+rest[1]+" is not attached")
+	case rest[0] == "services" && len(rest) == 1 && method == "POST":
+		port, _ := params["port"].(float64)
+		service := &Service{
+			Id:           fmt.Sprintf("%d", int(port)),
+			InternalPort: int(port),
+			ExternalIp:   "services-test.skytap.com",
+			ExternalPort: 20000 + len(nic.Services) + int(port),
+		}
+		nic.Services = append(nic.Services, service)
+		writeJSON(w, service)
+	case rest[0] == "services" && len(rest) == 2 && method == "DELETE":
+		for i, service := range nic.Services {
+			if service.Id == rest[1] {
+				nic.Services = append(nic.Services[:i], nic.Services[i+1:]...)
+				writeJSON(w, map[string]string{})
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, "no such service "+rest[1])
+	default:
+		writeError(w, http.StatusNotFound, "unknown interface endpoint")
+	}
+}
+
+func (s *Server) serveVpnAttachment(w http.ResponseWriter, method string, env *Environment, networkId string, rest []string, params map[string]interface{}) {
+	var network *Network
+	for _, n := range env.Networks {
+		if n.Id == networkId {
+			network = n
+		}
+	}
+	if network == nil {
+		writeError(w, http.StatusNotFound, "no such network "+networkId)
+		return
+	}
+
+	if len(rest) == 0 {
+		if method != "POST" {
+			writeError(w, http.StatusMethodNotAllowed, method)
+			return
+		}
+		vpnId, _ := params["vpn_id"].(string)
+		vpn, ok := s.Vpns[vpnId]
+		if !ok {
+			writeError(w, http.StatusNotFound, "no such VPN "+vpnId)
+			return
+		}
+		attachment := &VpnAttachment{Id: network.Id + "-" + vpn.Id, Vpn: vpn}
+		network.VpnAttachments = append(network.VpnAttachments, attachment)
+		s.assignNatAddresses(env, network, vpn)
+		writeJSON(w, attachment)
+		return
+	}
+
+	for i, attachment := range network.VpnAttachments {
+		if attachment.Vpn.Id != rest[0] {
+			continue
+		}
+		switch method {
+		case "PUT":
+			if connected, ok := params["connected"].(bool); ok {
+				attachment.Connected = connected
+			}
+			writeJSON(w, attachment)
+		case "DELETE":
+			if attachment.Connected {
+				writeError(w, http.StatusUnprocessableEntity, "VPN must be disconnected before detaching")
+				return
+			}
+			network.VpnAttachments = append(network.VpnAttachments[:i], network.VpnAttachments[i+1:]...)
+			writeJSON(w, map[string]string{})
+		default:
+			writeError(w, http.StatusMethodNotAllowed, method)
+		}
+		return
+	}
+	writeError(w, http.StatusNotFound, "VPN "+rest[0]+" is not attached")
+}
+
+// assignNatAddresses gives every interface on the network a NAT address for
+// the newly attached VPN.
+func (s *Server) assignNatAddresses(env *Environment, network *Network, vpn *Vpn) {
+	for _, vmId := range env.VmIds {
+		for _, nic := range s.VMs[vmId].Interfaces {
+			if nic.NetworkId == network.Id {
+				nat := VpnNatAddress{VpnId: vpn.Id, IpAddress: "172.16." + strings.TrimPrefix(nic.Ip, "10.0.")}
+				nic.NatAddresses.VpnNatAddresses = append(nic.NatAddresses.VpnNatAddresses, nat)
+			}
+		}
+	}
+}
+
+func (s *Server) serveTunnels(w http.ResponseWriter, method string, parts []string, params map[string]interface{}) {
+	if len(parts) == 0 && method == "POST" {
+		sourceId, _ := params["source_network_id"].(string)
+		targetId, _ := params["target_network_id"].(string)
+		sourceEnv, source := s.findNetwork(sourceId)
+		_, target := s.findNetwork(targetId)
+		if source == nil || target == nil {
+			writeError(w, http.StatusNotFound, "no such network")
+			return
+		}
+		tunnel := &Tunnel{
+			Id:            "tunnel-" + source.Id + "-" + target.Id,
+			Status:        "connected",
+			SourceNetwork: NetworkLink{source.Id, source.Name},
+			TargetNetwork: NetworkLink{target.Id, target.Name},
+		}
+		if _, exists := s.Tunnels[tunnel.Id]; exists {
+			writeError(w, http.StatusUnprocessableEntity, "networks are already connected")
+			return
+		}
+		s.Tunnels[tunnel.Id] = tunnel
+		source.Tunnels = append(source.Tunnels, tunnel)
+		target.Tunnels = append(target.Tunnels, tunnel)
+		for _, vmId := range sourceEnv.VmIds {
+			for _, nic := range s.VMs[vmId].Interfaces {
+				if nic.NetworkId == source.Id {
+					nat := NetworkNatAddress{NetworkId: target.Id, IpAddress: "192.168." + strings.TrimPrefix(nic.Ip, "10.0.")}
+					nic.NatAddresses.NetworkNatAddresses = append(nic.NatAddresses.NetworkNatAddresses, nat)
+				}
+			}
+		}
+		writeJSON(w, tunnel)
+		return
+	}
+	if len(parts) == 1 && method == "DELETE" {
+		tunnel, ok := s.Tunnels[parts[0]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "no such tunnel "+parts[0])
+			return
+		}
+		delete(s.Tunnels, tunnel.Id)
+		for _, id := range []string{tunnel.SourceNetwork.Id, tunnel.TargetNetwork.Id} {
+			if _, network := s.findNetwork(id); network != nil {
+				for i, t := range network.Tunnels {
+					if t == tunnel {
+						network.Tunnels = append(network.Tunnels[:i], network.Tunnels[i+1:]...)
+						break
+					}
+				}
+			}
+		}
+		writeJSON(w, map[string]string{})
+		return
+	}
+	writeError(w, http.StatusMethodNotAllowed, method)
+}
+
+func (s *Server) findNetwork(networkId string) (*Environment, *Network) {
+	for _, env := range s.Environments {
+		for _, network := range env.Networks {
+			if network.Id == networkId {
+				return env, network
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (s *Server) serveTemplates(w http.ResponseWriter, method string, parts []string, params map[string]interface{}) {
+	if len(parts) == 0 {
+		switch method {
+		case "GET":
+			var templates []map[string]interface{}
+			for _, t := range s.Templates {
+				templates = append(templates, s.templateView(t))
+			}
+			writeJSON(w, templates)
+		case "POST":
+			t, err := s.createTemplate(params)
+			if err != nil {
+				writeError(w, http.StatusUnprocessableEntity, err.Error())
+				return
+			}
+			writeJSON(w, s.templateView(t))
+		default:
+			writeError(w, http.StatusMethodNotAllowed, method)
+		}
+		return
+	}
+	t, ok := s.Templates[parts[0]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such template "+parts[0])
+		return
+	}
+	if len(parts) == 1 && method == "PUT" {
+		if name, ok := params["name"].(string); ok {
+			t.Name = name
+		}
+		writeJSON(w, s.templateView(t))
+		return
+	}
+	if method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, method)
+		return
+	}
+	if len(parts) == 3 && parts[1] == "vms" {
+		vm, ok := s.VMs[parts[2]]
+		if !ok || vm.TemplateId != t.Id {
+			writeError(w, http.StatusNotFound, "no such VM "+parts[2]+" in template "+t.Id)
+			return
+		}
+		writeJSON(w, s.vmView(vm))
+		return
+	}
+	writeJSON(w, s.templateView(t))
+}
+
+// createTemplate saves an environment as a new template, optionally
+// restricted to some of its VMs.
+func (s *Server) createTemplate(params map[string]interface{}) (*Template, error) {
+	envId, _ := params["configuration_id"].(string)
+	env, ok := s.Environments[envId]
+	if !ok {
+		return nil, fmt.Errorf("no such environment %s", envId)
+	}
+
+	var sources []*VM
+	for _, vmId := range stringList(params["vm_ids"], env.VmIds) {
+		source, ok := s.VMs[vmId]
+		if !ok || source.EnvironmentId != env.Id {
+			return nil, fmt.Errorf("VM %s is not in environment %s", vmId, env.Id)
+		}
+		sources = append(sources, source)
+	}
+
+	t := &Template{Id: s.newId(), Name: env.Name}
+	for _, source := range sources {
+		vm := s.cloneVM(source)
+		vm.TemplateId = t.Id
+		t.VmIds = append(t.VmIds, vm.Id)
+	}
+	s.Templates[t.Id] = t
+	return t, nil
+}
+
+func (s *Server) templateView(t *Template) map[string]interface{} {
+	var vms []*VM
+	for _, vmId := range t.VmIds {
+		vms = append(vms, s.VMs[vmId])
+	}
+	return map[string]interface{}{"id": t.Id, "name": t.Name, "busy": false, "vms": vms, "networks": t.Networks}
+}
+
+func (s *Server) serveProjects(w http.ResponseWriter, method string, parts []string) {
+	if len(parts) == 0 {
+		writeError(w, http.StatusNotFound, "no project specified")
+		return
+	}
+	project, ok := s.Projects[parts[0]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such project "+parts[0])
+		return
+	}
+	switch {
+	case len(parts) == 1 && method == "GET":
+		writeJSON(w, project)
+	case len(parts) == 3 && parts[1] == "configurations" && method == "POST":
+		if _, ok := s.Environments[parts[2]]; !ok {
+			writeError(w, http.StatusNotFound, "no such environment "+parts[2])
+			return
+		}
+		project.EnvironmentIds = append(project.EnvironmentIds, parts[2])
+		writeJSON(w, project)
+	default:
+		writeError(w, http.StatusNotFound, "unknown project endpoint")
+	}
+}
+
+func (s *Server) serveVpns(w http.ResponseWriter, method string, parts []string) {
+	if method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, method)
+		return
+	}
+	if len(parts) == 0 {
+		var vpns []*Vpn
+		for _, vpn := range s.Vpns {
+			vpns = append(vpns, vpn)
+		}
+		writeJSON(w, vpns)
+		return
+	}
+	vpn, ok := s.Vpns[parts[0]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such VPN "+parts[0])
+		return
+	}
+	writeJSON(w, vpn)
+}
+
+// addLabels records the labels of a request whose body is a list of
+// label_category and value pairs.
+func addLabels(labels map[string]string, params map[string]interface{}) {
+	items, _ := params["items"].([]interface{})
+	for _, item := range items {
+		if l, ok := item.(map[string]interface{}); ok {
+			category, _ := l["label_category"].(string)
+			value, _ := l["value"].(string)
+			labels[category] = value
+		}
+	}
+}
+
+// requestParams merges query string, form and JSON body parameters, since the
+// Skytap API accepts all three.
+func requestParams(r *http.Request) (map[string]interface{}, error) {
+	params := map[string]interface{}{}
+	for k, v := range r.URL.Query() {
+		params[strings.TrimSuffix(k, "[]")] = queryValue(k, v)
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) == 0 {
+		return params, nil
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range form {
+			params[strings.TrimSuffix(k, "[]")] = queryValue(k, v)
+		}
+		return params, nil
+	}
+	if strings.HasPrefix(strings.TrimSpace(string(body)), "[") {
+		var items []interface{}
+		if err := json.Unmarshal(body, &items); err != nil {
+			return nil, err
+		}
+		params["items"] = items
+		return params, nil
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		return nil, err
+	}
+	for k, v := range decoded {
+		params[k] = v
+	}
+	return params, nil
+}
+
+func queryValue(key string, values []string) interface{} {
+	if strings.HasSuffix(key, "[]") {
+		list := make([]interface{}, len(values))
+		for i, v := range values {
+			list[i] = v
+		}
+		return list
+	}
+	switch values[0] {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return values[0]
+}
+
+// stringList converts a decoded JSON or query list to strings, returning def
+// if the parameter was not supplied.
+func stringList(value interface{}, def []string) []string {
+	list, ok := value.([]interface{})
+	if !ok {
+		return def
+	}
+	var result []string
+	for _, v := range list {
+		result = append(result, fmt.Sprintf("%v", v))
+	}
+	return result
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,74 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/docker/machine/libmachine/log"
+)
+
+// Snapshot saves the machine's environment as a Skytap template with the
+// given name, or only the machine's VM when vmOnly is set, and returns the
+// template's ID. New machines can then be created from the template with
+// --skytap-template-id or --skytap-template-name, starting with whatever
+// images and caches the machine held. Only the VM is saved from an
+// environment that was not created for the machine, as the rest of it
+// belongs to other machines and users.
+func (d *Driver) Snapshot(name string, vmOnly bool) (string, error) {
+	d.SetLogLevel()
+	if name == "" {
+		return "", errors.New("A template name is required")
+	}
+	client := d.client()
+	envId := d.DeviceConfig.EnvironmentId
+	if !vmOnly && !d.OwnsEnvironment {
+		log.Infof("Environment %s was not created for this machine, saving only its VM", envId)
+		vmOnly = true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.createTimeout())
+	defer cancel()
+	unlock, err := d.lockEnvironment(ctx, envId)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	if _, err = waitForEnvironment(ctx, client, envId); err != nil {
+		return "", err
+	}
+
+	params := map[string]interface{}{"configuration_id": envId}
+	if vmOnly {
+		params["vm_ids"] = []string{d.Vm.Id}
+		log.Infof("Saving VM %s as template '%s'", d.Vm.Id, name)
+	} else {
+		log.Infof("Saving environment %s as template '%s'", envId, name)
+	}
+	var template templateDetails
+	if err = skytapRequest(client, "POST", "/templates", params, &template); err != nil {
+		return "", err
+	}
+	// Skytap names a new template after its environment.
+	if err = skytapRequest(client, "PUT", fmt.Sprintf("/templates/%s", template.Id), map[string]string{"name": name}, nil); err != nil {
+		return template.Id, err
+	}
+	if _, err = waitForTemplate(ctx, client, template.Id); err != nil {
+		return template.Id, err
+	}
+	return template.Id, nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing bool
+		vmOnly   bool
+		// wantVms are the names of the template's VMs. Every environment
+		// holds the machine and a VM named other.
+		wantVms []string
+	}{
+		{name: "own environment", wantVms: []string{testMachineName, "other"}},
+		{name: "own environment, VM only", vmOnly: true, wantVms: []string{testMachineName}},
+		{name: "existing environment", existing: true, wantVms: []string{testMachineName}},
+		{name: "existing environment, VM only", existing: true, vmOnly: true, wantVms: []string{testMachineName}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			flags := e.templateFlags()
+			if test.existing {
+				shared, _ := e.server.AddEnvironment("shared")
+				flags["skytap-env-id"] = shared.Id
+			}
+			d := e.create(flags)
+			e.server.AddVM(d.DeviceConfig.EnvironmentId, "other")
+
+			templateId, err := d.Snapshot("golden-machine", test.vmOnly)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			e.server.Lock()
+			defer e.server.Unlock()
+			template := e.server.Templates[templateId]
+			if template == nil {
+				t.Fatalf("template %s not found", templateId)
+			}
+			if template.Name != "golden-machine" {
+				t.Errorf("template named %q", template.Name)
+			}
+			var names []string
+			for _, vmId := range template.VmIds {
+				names = append(names, e.server.VMs[vmId].Name)
+			}
+			if !reflect.DeepEqual(names, test.wantVms) {
+				t.Errorf("template VMs %v, want %v", names, test.wantVms)
+			}
+		})
+	}
+}
+
+func TestSnapshotRequiresName(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	d := e.create(e.templateFlags())
+
+	_, err := d.Snapshot("", false)
+	checkError(t, err, "A template name is required")
+}
+
+func TestCreateFromSnapshot(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	first := e.create(e.templateFlags())
+	templateId, err := first.Snapshot("golden-machine", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = first.Remove(); err != nil {
+		t.Fatal(err)
+	}
+
+	second := e.create(map[string]interface{}{"skytap-template-id": templateId, "skytap-public-ip": publicIpAuto})
+
+	if second.DeviceConfig.EnvironmentId == first.DeviceConfig.EnvironmentId {
+		t.Error("machine created in the snapshotted machine's environment")
+	}
+	if e.vm(second.Vm.Id) == nil {
+		t.Error("machine created from the snapshot has no VM")
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// sshServer stands in for the SSH service of a VM that accepts a single
+// public key and no passwords. Every command succeeds.
+type sshServer struct {
+	sync.Mutex
+	listener  net.Listener
+	config    *ssh.ServerConfig
+	passwords int
+	commands  []string
+}
+
+func newSshServer(t *testing.T, authorized ssh.PublicKey) *sshServer {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &sshServer{listener: listener}
+	s.config = &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("key not authorized")
+		},
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			s.Lock()
+			defer s.Unlock()
+			s.passwords++
+			return nil, errors.New("password authentication is disabled")
+		},
+	}
+	s.config.AddHostKey(hostSigner)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *sshServer) serve(conn net.Conn) {
+	_, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+				var exec struct{ Command string }
+				ssh.Unmarshal(req.Payload, &exec)
+				s.Lock()
+				s.commands = append(s.commands, exec.Command)
+				s.Unlock()
+				req.Reply(true, nil)
+				channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+				channel.Close()
+			}
+		}()
+	}
+}
+
+// seen returns the number of password attempts and the commands run so far.
+func (s *sshServer) seen() (int, []string) {
+	s.Lock()
+	defer s.Unlock()
+	return s.passwords, append([]string(nil), s.commands...)
+}
+
+func (s *sshServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *sshServer) close() {
+	s.listener.Close()
+}
+
+// connect points the machine at the server.
+func (s *sshServer) connect(d *Driver) {
+	d.IPAddress = "127.0.0.1"
+	d.SSHPort = s.port()
+}
+
+func newSshKey(t *testing.T) ed25519.PrivateKey {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func checkNoCredentialsRead(t *testing.T, e *testEnv) {
+	for _, request := range e.server.Requests() {
+		if strings.Contains(request, "/credentials") {
+			t.Errorf("VM credentials were read: %s", request)
+		}
+	}
+}
+
+func TestProvidedSshKeyIsInstalled(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	key := newSshKey(t)
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(e.storePath, "id_provided")
+	if err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newSshServer(t, signer.PublicKey())
+	defer server.close()
+
+	flags := e.templateFlags()
+	flags["skytap-ssh-key"] = keyPath
+	d := e.create(flags)
+	server.connect(d)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err = d.GenerateSshKeyAndCopy(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	copied, err := ioutil.ReadFile(d.GetSSHKeyPath())
+	if err != nil {
+		t.Fatalf("key not copied into the machine store: %s", err)
+	}
+	if original, _ := ioutil.ReadFile(keyPath); !bytes.Equal(copied, original) {
+		t.Error("machine store holds a different key")
+	}
+	public, err := ioutil.ReadFile(d.GetSSHKeyPath() + ".pub")
+	if err != nil {
+		t.Fatalf("public key not written: %s", err)
+	}
+	if want := ssh.MarshalAuthorizedKey(signer.PublicKey()); !bytes.Equal(public, want) {
+		t.Errorf("public key %q, want %q", public, want)
+	}
+	passwords, commands := server.seen()
+	if strings.Join(commands, "; ") != "exit 0" {
+		t.Errorf("ran %v, want only a connection check", commands)
+	}
+	if passwords != 0 {
+		t.Errorf("%d password attempts", passwords)
+	}
+	checkNoCredentialsRead(t, e)
+}
+
+func TestSshAgentIdentitiesSkipCredentials(t *testing.T) {
+	tests := []struct {
+		name       string
+		authorized bool
+		wantErr    string
+	}{
+		{"agent identity accepted", true, ""},
+		{"agent identity rejected", false, "unable to authenticate"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			key := newSshKey(t)
+			keyring := agent.NewKeyring()
+			if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+				t.Fatal(err)
+			}
+			sock := filepath.Join(e.storePath, "agent.sock")
+			listener, err := net.Listen("unix", sock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			go func() {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					go agent.ServeAgent(keyring, conn)
+				}
+			}()
+			defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+			os.Setenv("SSH_AUTH_SOCK", sock)
+
+			authorized := newSshKey(t)
+			if test.authorized {
+				authorized = key
+			}
+			public, err := ssh.NewPublicKey(authorized.Public())
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := newSshServer(t, public)
+			defer server.close()
+			d := e.create(e.templateFlags())
+			server.connect(d)
+
+			auth, err := d.bootstrapAuthMethods(d.client())
+			if err != nil {
+				t.Fatal(err)
+			}
+			sshClient, err := d.dialSsh(auth)
+			if err == nil {
+				sshClient.Close()
+			}
+
+			checkError(t, err, test.wantErr)
+			if passwords, _ := server.seen(); passwords != 0 {
+				t.Errorf("%d password attempts", passwords)
+			}
+			checkNoCredentialsRead(t, e)
+		})
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/skytap/skytap-sdk-go/api"
+)
+
+// stateCacheFile holds the VM details and IP address last read from Skytap,
+// next to the machine's config. docker-machine only saves the config after
+// commands that change the machine, so without it the details read by
+// commands such as ls and env would be thrown away and read again next time.
+const stateCacheFile = "skytap-state.json"
+
+type stateCache struct {
+	ResolvedAt time.Time
+	IPAddress  string
+	Vm         api.VirtualMachine
+}
+
+// loadStateCache adopts the cached VM details and IP address if they were
+// read from Skytap more recently than those in the machine config.
+func (d *Driver) loadStateCache() {
+	data, err := ioutil.ReadFile(d.ResolveStorePath(stateCacheFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Debugf("Unable to read state cache: %s", err)
+		}
+		return
+	}
+	var cache stateCache
+	if err = json.Unmarshal(data, &cache); err != nil {
+		log.Debugf("Ignoring invalid state cache: %s", err)
+		return
+	}
+	if cache.Vm.Id != d.Vm.Id || !cache.ResolvedAt.After(d.ResolvedAt) {
+		return
+	}
+	d.Vm = cache.Vm
+	d.IPAddress = cache.IPAddress
+	d.ResolvedAt = cache.ResolvedAt
+}
+
+// saveStateCache stores the VM details and IP address for the next command.
+// The file is replaced rather than rewritten so that commands running in
+// parallel never read it half written.
+func (d *Driver) saveStateCache() {
+	data, err := json.Marshal(stateCache{d.ResolvedAt, d.IPAddress, d.Vm})
+	if err != nil {
+		log.Debugf("Unable to encode state cache: %s", err)
+		return
+	}
+	path := d.ResolveStorePath(stateCacheFile)
+	file, err := ioutil.TempFile(d.ResolveStorePath("."), stateCacheFile)
+	if err != nil {
+		log.Debugf("Unable to write state cache: %s", err)
+		return
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		log.Debugf("Unable to write state cache: %s", err)
+		os.Remove(file.Name())
+	}
+}
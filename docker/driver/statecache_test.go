@@ -0,0 +1,119 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/docker/machine/libmachine/state"
+)
+
+// reload returns a copy of the driver as the next docker-machine command
+// would load it from the machine config.
+func reload(t *testing.T, e *testEnv, d *Driver) *Driver {
+	data, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := &Driver{}
+	if err = json.Unmarshal(data, loaded); err != nil {
+		t.Fatal(err)
+	}
+	loaded.HTTPClient = e.server.Client()
+	loaded.RetryPolicy = d.RetryPolicy
+	return loaded
+}
+
+func TestGetURLStateCache(t *testing.T) {
+	tests := []struct {
+		name         string
+		ttl          int
+		age          time.Duration
+		wantRequests bool
+	}{
+		{"recent read is reused", 60, 10 * time.Second, false},
+		{"expired read is refreshed", 60, 2 * time.Minute, true},
+		{"missing read is refreshed", 60, 0, true},
+		{"cache disabled", 0, time.Second, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			flags := e.templateFlags()
+			flags["skytap-state-cache-ttl"] = test.ttl
+			d := e.create(flags)
+			d.LastState = state.Running
+			d.ResolvedAt = time.Time{}
+			if test.age > 0 {
+				d.ResolvedAt = time.Now().Add(-test.age)
+			}
+			before := len(e.server.Requests())
+
+			url, err := d.GetURL()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if url != "tcp://"+testPublicIp+":2376" {
+				t.Errorf("URL %q", url)
+			}
+			if requested := len(e.server.Requests()) > before; requested != test.wantRequests {
+				t.Errorf("asked Skytap: %v, want %v", requested, test.wantRequests)
+			}
+			if test.wantRequests && time.Since(d.ResolvedAt) > time.Minute {
+				t.Errorf("refreshed read recorded at %s", d.ResolvedAt)
+			}
+		})
+	}
+}
+
+func TestGetURLSharesStateCache(t *testing.T) {
+	e := newTestEnv(t)
+	defer e.close()
+	d := e.create(e.templateFlags())
+	d.LastState = state.Running
+	d.ResolvedAt = time.Now().Add(-time.Hour)
+	config := reload(t, e, d)
+
+	// Each command starts from the saved config, which holds the old read.
+	first := reload(t, e, config)
+	if _, err := first.GetURL(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(first.ResolveStorePath(stateCacheFile)); err != nil {
+		t.Fatalf("state cache not written: %s", err)
+	}
+	before := len(e.server.Requests())
+	second := reload(t, e, config)
+	url, err := second.GetURL()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "tcp://"+testPublicIp+":2376" {
+		t.Errorf("URL %q", url)
+	}
+	if requests := e.server.Requests()[before:]; len(requests) != 0 {
+		t.Errorf("second command asked Skytap again: %v", requests)
+	}
+	if !second.ResolvedAt.Equal(first.ResolvedAt) {
+		t.Errorf("second command read at %s, want the first command's read at %s", second.ResolvedAt, first.ResolvedAt)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/machine/libmachine/log"
+	"github.com/skytap/skytap-sdk-go/api"
+)
+
+// Version is the driver version recorded in the default tags. Release builds
+// set it with -ldflags "-X".
+var Version = "dev"
+
+type tag struct {
+	Value string `json:"value"`
+}
+
+type label struct {
+	Category string `json:"label_category"`
+	Value    string `json:"value"`
+}
+
+func addEnvironmentTags(client api.SkytapClient, envId string, tags []string) error {
+	var params []tag
+	for _, value := range tags {
+		params = append(params, tag{value})
+	}
+	return skytapRequest(client, "PUT", fmt.Sprintf("/configurations/%s/tags", envId), params, nil)
+}
+
+func addLabels(client api.SkytapClient, path string, labels []label) error {
+	return skytapRequest(client, "PUT", "/v2"+path+"/labels", labels, nil)
+}
+
+// parseLabels parses --skytap-label values of the form category=value.
+func parseLabels(values []string) ([]label, error) {
+	var labels []label
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid label '%s', must be category=value", value)
+		}
+		labels = append(labels, label{parts[0], parts[1]})
+	}
+	return labels, nil
+}
+
+// defaultTags records which machine and driver version created an
+// environment.
+func (d *Driver) defaultTags() []string {
+	return []string{
+		"docker-machine=" + d.MachineName,
+		"docker-machine-driver=" + driverName + "-" + Version,
+	}
+}
+
+// applyTags tags and labels what Create made: the environment, if this
+// machine created it, and the VM. Skytap only supports tags on environments,
+// so the VM gets the labels alone.
+func (d *Driver) applyTags(client api.SkytapClient, envId, vmId string) error {
+	labels, err := parseLabels(d.Labels)
+	if err != nil {
+		return err
+	}
+
+	if d.OwnsEnvironment {
+		tags := append(d.defaultTags(), d.Tags...)
+		log.Infof("Tagging environment %s with %s", envId, strings.Join(tags, ", "))
+		if err := addEnvironmentTags(client, envId, tags); err != nil {
+			return err
+		}
+		if len(labels) > 0 {
+			if err := addLabels(client, "/configurations/"+envId, labels); err != nil {
+				return err
+			}
+		}
+	} else {
+		log.Infof("Environment %s was not created for this machine, leaving its tags and labels alone", envId)
+	}
+	if len(labels) > 0 {
+		log.Infof("Labelling VM %s", vmId)
+		return addLabels(client, "/vms/"+vmId, labels)
+	}
+	return nil
+}
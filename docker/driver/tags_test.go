@@ -0,0 +1,115 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLabels(t *testing.T) {
+	tests := []struct {
+		values  []string
+		want    []label
+		wantErr string
+	}{
+		{nil, nil, ""},
+		{[]string{"team=docker", "cost=a=b"}, []label{{"team", "docker"}, {"cost", "a=b"}}, ""},
+		{[]string{"team"}, nil, "Invalid label 'team'"},
+		{[]string{"=docker"}, nil, "Invalid label '=docker'"},
+		{[]string{"team="}, nil, "Invalid label 'team='"},
+	}
+	for _, test := range tests {
+		got, err := parseLabels(test.values)
+		checkError(t, err, test.wantErr)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parsed %v as %v, want %v", test.values, got, test.want)
+		}
+	}
+}
+
+func TestCreateTagsAndLabels(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing bool
+		tags     []string
+		// wantEnvTags are the environment's tags after create, in
+		// addition to the default ones for a new environment.
+		wantEnvTags   []string
+		wantEnvLabels map[string]string
+	}{
+		{
+			name:          "new environment",
+			tags:          []string{"team=docker"},
+			wantEnvTags:   []string{"docker-machine=" + testMachineName, "docker-machine-driver=" + driverName + "-" + Version, "team=docker"},
+			wantEnvLabels: map[string]string{"cost-center": "42"},
+		},
+		{
+			name:     "existing environment",
+			existing: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			shared, _ := e.server.AddEnvironment("shared", "other")
+			flags := e.templateFlags()
+			flags["skytap-tag"] = test.tags
+			flags["skytap-label"] = []string{"cost-center=42"}
+			if test.existing {
+				flags["skytap-env-id"] = shared.Id
+			}
+			d := e.create(flags)
+
+			env := e.environment(d.DeviceConfig.EnvironmentId)
+			vm := e.vm(d.Vm.Id)
+			e.server.Lock()
+			defer e.server.Unlock()
+			if !reflect.DeepEqual(env.Tags, test.wantEnvTags) {
+				t.Errorf("environment tags %v, want %v", env.Tags, test.wantEnvTags)
+			}
+			if !reflect.DeepEqual(env.Labels, test.wantEnvLabels) {
+				t.Errorf("environment labels %v, want %v", env.Labels, test.wantEnvLabels)
+			}
+			if want := map[string]string{"cost-center": "42"}; !reflect.DeepEqual(vm.Labels, want) {
+				t.Errorf("VM labels %v, want %v", vm.Labels, want)
+			}
+		})
+	}
+}
+
+func TestTagsRequireNewEnvironment(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags map[string]interface{}
+	}{
+		{"environment ID", map[string]interface{}{"skytap-env-id": "1"}},
+		{"environment name", map[string]interface{}{"skytap-env-name": "shared"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			defer e.close()
+			test.flags["skytap-template-id"] = "1"
+			test.flags["skytap-tag"] = []string{"team=docker"}
+
+			_, err := e.configure(test.flags)
+			checkError(t, err, "Tags only apply when no environment is selected")
+		})
+	}
+}
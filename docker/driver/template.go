@@ -0,0 +1,96 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"fmt"
+
+	"github.com/skytap/skytap-sdk-go/api"
+)
+
+// templateDetails is a Skytap template along with its VMs.
+type templateDetails struct {
+	Id       string                `json:"id"`
+	Name     string                `json:"name"`
+	Busy     bool                  `json:"busy"`
+	Vms      []*api.VirtualMachine `json:"vms"`
+	Networks []api.Network         `json:"networks"`
+}
+
+// machineSource is the VM a machine is created from, and the template it
+// belongs to if it was given as a template.
+type machineSource struct {
+	vm         *api.VirtualMachine
+	templateId string
+}
+
+func getTemplate(client api.SkytapClient, templateId string) (*templateDetails, error) {
+	var template templateDetails
+	if err := skytapRequest(client, "GET", fmt.Sprintf("/templates/%s", templateId), nil, &template); err != nil {
+		return nil, err
+	}
+	return &template, nil
+}
+
+// addTemplateVm adds a VM of a template to an existing environment and
+// returns the updated environment.
+func addTemplateVm(client api.SkytapClient, envId, templateId, vmId string) (*api.Environment, error) {
+	var env api.Environment
+	params := map[string]interface{}{"template_id": templateId, "vm_ids": []string{vmId}}
+	if err := skytapRequest(client, "PUT", fmt.Sprintf("/configurations/%s", envId), params, &env); err != nil {
+		return nil, err
+	}
+	return &env, nil
+}
+
+// resolveSource looks up the VM given with --skytap-vm-id, or the VM of the
+// template given with --skytap-template-id. A template with several VMs
+// needs --skytap-template-vm-name to pick one.
+func (d *Driver) resolveSource(client api.SkytapClient) (*machineSource, error) {
+	if d.DeviceConfig.TemplateId == "" {
+		vm, err := api.GetVirtualMachine(client, d.DeviceConfig.SourceVMId)
+		if err != nil {
+			return nil, err
+		}
+		return &machineSource{vm: vm}, nil
+	}
+
+	template, err := getTemplate(client, d.DeviceConfig.TemplateId)
+	if err != nil {
+		return nil, err
+	}
+	name := d.DeviceConfig.TemplateVMName
+	if name == "" {
+		if len(template.Vms) != 1 {
+			return nil, fmt.Errorf("Template %s has %d VMs, use --skytap-template-vm-name to choose one", template.Id, len(template.Vms))
+		}
+		return &machineSource{template.Vms[0], template.Id}, nil
+	}
+
+	var found *api.VirtualMachine
+	for _, vm := range template.Vms {
+		if vm.Name != name {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("More than one VM named '%s' in template %s", name, template.Id)
+		}
+		found = vm
+	}
+	if found == nil {
+		return nil, fmt.Errorf("VM '%s' not found in template %s", name, template.Id)
+	}
+	return &machineSource{found, template.Id}, nil
+}
@@ -0,0 +1,186 @@
+// Copyright 2016 Skytap Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/log"
+	"github.com/skytap/skytap-sdk-go/api"
+)
+
+const (
+	defaultCreateTimeout = 1800
+	defaultSSHTimeout    = 300
+	defaultPhaseTimeout  = 900
+	// nicRenameAttempts is how many times renaming the new VM's network
+	// interface is tried, since Skytap may still be settling the interface
+	// right after the VM was created.
+	nicRenameAttempts = 3
+)
+
+// pollInterval is how often Skytap is asked whether a change has finished.
+var pollInterval = 5 * time.Second
+
+// sshRetryInterval is how long the VM's SSH service is given to come up
+// before each attempt to connect to it.
+var sshRetryInterval = 10 * time.Second
+
+// The steps that reach the machine itself rather than the Skytap API, which
+// tests replace since the fake API has no VMs to connect to.
+var (
+	installSshKey = (*Driver).GenerateSshKeyAndCopy
+	probeMachine  = (*Driver).probeDocker
+	runSSHCommand = drivers.RunSSHCommandFromDriver
+)
+
+// Phases of creating or starting a machine that have their own deadline.
+const (
+	phaseEnvironmentReady = "environment ready"
+	phaseVpnConnect       = "VPN connect"
+	phaseIcnrConnect      = "ICNR connect"
+	phaseNewEnvironment   = "environment create"
+	phaseNicRename        = "NIC rename"
+	phaseVmName           = "VM rename"
+	phaseHardware         = "hardware update"
+	phaseDisks            = "disk provisioning"
+	phaseContainerHost    = "container host"
+	phaseStart            = "start"
+	phaseSSH              = "SSH"
+	phaseDocker           = "Docker daemon"
+)
+
+// phaseTimeoutError reports which phase of an operation ran out of time.
+type phaseTimeoutError struct {
+	phase   string
+	timeout time.Duration
+	// cause is the last error seen before time ran out, if it was not the
+	// deadline itself.
+	cause error
+}
+
+func (e *phaseTimeoutError) Error() string {
+	msg := fmt.Sprintf("Timed out waiting for %s (phase limit %s, or the overall timeout was reached)", e.phase, e.timeout)
+	if e.cause != nil {
+		msg += fmt.Sprintf(", last error: %s", e.cause)
+	}
+	return msg
+}
+
+// runPhase runs operation with a context that expires after timeout or when
+// ctx does, whichever comes first. If the operation fails because that
+// context expired, the error names the phase.
+func runPhase(ctx context.Context, phase string, timeout time.Duration, operation func(ctx context.Context) error) error {
+	log.Debugf("Starting phase '%s' with a limit of %s", phase, timeout)
+	phaseCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := operation(phaseCtx)
+	if err != nil && phaseCtx.Err() == context.DeadlineExceeded {
+		if err == context.DeadlineExceeded {
+			err = nil
+		}
+		return &phaseTimeoutError{phase, timeout, err}
+	}
+	return err
+}
+
+// sleepContext sleeps for the given duration, returning early with the
+// context's error if it is done first.
+func sleepContext(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// waitForEnvironment polls an environment until Skytap no longer reports it
+// as busy.
+func waitForEnvironment(ctx context.Context, client api.SkytapClient, envId string) (*api.Environment, error) {
+	for {
+		env, err := api.GetEnvironment(client, envId)
+		if err != nil {
+			return nil, err
+		}
+		if env.Runstate != api.RunStateBusy {
+			return env, nil
+		}
+		log.Debugf("Environment %s is busy, waiting %s", envId, pollInterval)
+		if err = sleepContext(ctx, pollInterval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// waitForVm polls a VM until Skytap no longer reports it as busy.
+func waitForVm(ctx context.Context, client api.SkytapClient, vmId string) (*api.VirtualMachine, error) {
+	for {
+		vm, err := api.GetVirtualMachine(client, vmId)
+		if err != nil {
+			return nil, err
+		}
+		if vm.Runstate != api.RunStateBusy {
+			return vm, nil
+		}
+		log.Debugf("VM %s is busy, waiting %s", vmId, pollInterval)
+		if err = sleepContext(ctx, pollInterval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// waitForTemplate polls a template until Skytap has finished copying VMs
+// into it.
+func waitForTemplate(ctx context.Context, client api.SkytapClient, templateId string) (*templateDetails, error) {
+	for {
+		template, err := getTemplate(client, templateId)
+		if err != nil {
+			return nil, err
+		}
+		if !template.Busy {
+			return template, nil
+		}
+		log.Debugf("Template %s is busy, waiting %s", templateId, pollInterval)
+		if err = sleepContext(ctx, pollInterval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (d *Driver) createTimeout() time.Duration {
+	return secondsOrDefault(d.CreateTimeout, defaultCreateTimeout)
+}
+
+func (d *Driver) phaseTimeout() time.Duration {
+	return secondsOrDefault(d.PhaseTimeout, defaultPhaseTimeout)
+}
+
+func (d *Driver) sshTimeout() time.Duration {
+	return secondsOrDefault(d.SSHTimeout, defaultSSHTimeout)
+}
+
+func secondsOrDefault(seconds, def int) time.Duration {
+	if seconds <= 0 {
+		seconds = def
+	}
+	return time.Duration(seconds) * time.Second
+}